@@ -0,0 +1,254 @@
+// Package auth protects the bot's HTTP control endpoints with a static token,
+// basic auth and/or a file of users with roles, and guards state-changing
+// requests against cross-site request forgery.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Role int
+
+const (
+	// Viewer may only look at the dashboard and read state.
+	Viewer Role = iota + 1
+	// Moderator may also invite, uninvite and perform other actions.
+	Moderator
+)
+
+func (r Role) String() string {
+	switch r {
+	case Viewer:
+		return "viewer"
+	case Moderator:
+		return "moderator"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+func parseRole(s string) (Role, error) {
+	switch s {
+	case "viewer":
+		return Viewer, nil
+	case "moderator":
+		return Moderator, nil
+	}
+	return 0, fmt.Errorf("unknown role %q", s)
+}
+
+type Config struct {
+	// Token grants moderator access when sent as a bearer token, or as the
+	// basic auth password with any user name.
+	Token string
+	// Basic is a "user:password" pair granting moderator access.
+	Basic string
+	// UsersFile is a JSON list of users, e.g.
+	// [{"username": "ann", "password_sha256": "<hex>", "role": "viewer"}].
+	UsersFile string
+}
+
+type user struct {
+	Username       string `json:"username"`
+	PasswordSHA256 string `json:"password_sha256"`
+	Role           string `json:"role"`
+	role           Role
+}
+
+type Authenticator struct {
+	token  string
+	users  map[string]*user
+	secret []byte
+}
+
+func New(cfg Config) (*Authenticator, error) {
+	a := &Authenticator{token: cfg.Token, users: make(map[string]*user), secret: make([]byte, 32)}
+	if _, err := rand.Read(a.secret); err != nil {
+		return nil, fmt.Errorf("could not generate CSRF secret: %v", err)
+	}
+	if cfg.Basic != "" {
+		parts := strings.SplitN(cfg.Basic, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("basic auth must be given as user:password")
+		}
+		sum := sha256.Sum256([]byte(parts[1]))
+		a.users[parts[0]] = &user{Username: parts[0], PasswordSHA256: hex.EncodeToString(sum[:]), role: Moderator}
+	}
+	if cfg.UsersFile != "" {
+		data, err := ioutil.ReadFile(cfg.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read users file: %v", err)
+		}
+		var users []*user
+		if err := json.Unmarshal(data, &users); err != nil {
+			return nil, fmt.Errorf("could not parse users file %s: %v", cfg.UsersFile, err)
+		}
+		for _, u := range users {
+			if u.role, err = parseRole(u.Role); err != nil {
+				return nil, fmt.Errorf("user %q: %v", u.Username, err)
+			}
+			a.users[u.Username] = u
+		}
+	}
+	if !a.Enabled() {
+		log.Printf("WARN: control endpoint authentication is disabled")
+	}
+	return a, nil
+}
+
+// Enabled reports whether any credentials are configured. Without them all
+// requests are treated as coming from a moderator, but are still subject to
+// CSRF checks.
+func (a *Authenticator) Enabled() bool {
+	return a.token != "" || len(a.users) > 0
+}
+
+// CheckAddr returns an error if addr would expose the control endpoint beyond
+// the local host without credentials to protect it.
+func (a *Authenticator) CheckAddr(addr string) error {
+	if a.Enabled() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("refusing to serve the control endpoint on %q without authentication; listen on a loopback address or configure credentials", addr)
+}
+
+type identity struct {
+	name   string
+	role   Role
+	bearer bool
+	csrf   string
+}
+
+type contextKey struct{}
+
+// CSRFToken returns the token that forms submitted by the user making req
+// must include as csrf_token, or "" if req did not pass through Wrap.
+func CSRFToken(req *http.Request) string {
+	if id, ok := req.Context().Value(contextKey{}).(*identity); ok {
+		return id.csrf
+	}
+	return ""
+}
+
+// Wrap authenticates requests to h. Requests other than GET and HEAD require
+// the moderator role and, unless authenticated with a bearer token, a CSRF
+// token or a JSON body sent from the same origin.
+func (a *Authenticator) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := a.authenticate(req)
+		if id == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="housebot"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id.csrf = a.csrfToken(id.name)
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			if id.role < Moderator {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if !id.bearer {
+				if err := a.checkCSRF(req, id); err != nil {
+					log.Printf("WARN: rejected %s %s from %s: %v", req.Method, req.URL.Path, req.RemoteAddr, err)
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, id)))
+	})
+}
+
+func (a *Authenticator) authenticate(req *http.Request) *identity {
+	if !a.Enabled() {
+		return &identity{role: Moderator}
+	}
+	if h := req.Header.Get("Authorization"); a.token != "" && strings.HasPrefix(h, "Bearer ") {
+		if equal(strings.TrimPrefix(h, "Bearer "), a.token) {
+			return &identity{name: "token", role: Moderator, bearer: true}
+		}
+		return nil
+	}
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return nil
+	}
+	if a.token != "" && equal(password, a.token) {
+		return &identity{name: name, role: Moderator}
+	}
+	u, ok := a.users[name]
+	if !ok {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(password))
+	if !equal(hex.EncodeToString(sum[:]), strings.ToLower(u.PasswordSHA256)) {
+		return nil
+	}
+	return &identity{name: name, role: u.role}
+}
+
+func (a *Authenticator) csrfToken(name string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *Authenticator) checkCSRF(req *http.Request, id *identity) error {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != req.Host {
+			return fmt.Errorf("cross-origin request from %q", origin)
+		}
+	}
+	if t := req.Header.Get("X-CSRF-Token"); t != "" {
+		if equal(t, id.csrf) {
+			return nil
+		}
+		return fmt.Errorf("invalid CSRF token")
+	}
+	// Browsers will not send a cross-origin JSON body without a CORS
+	// preflight, which we never grant.
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	if equal(req.PostFormValue("csrf_token"), id.csrf) {
+		return nil
+	}
+	return fmt.Errorf("missing or invalid CSRF token")
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// ListenAndServe serves h on addr, over TLS if certFile and keyFile are set.
+func ListenAndServe(addr, certFile, keyFile string, h http.Handler) error {
+	if certFile != "" || keyFile != "" {
+		log.Printf("Listening %s (TLS)", addr)
+		return http.ListenAndServeTLS(addr, certFile, keyFile, h)
+	}
+	log.Printf("Listening %s", addr)
+	return http.ListenAndServe(addr, h)
+}
@@ -17,6 +17,10 @@ var (
 	idleThreshold = 20 // -20dB or quieter
 )
 
+// StreamLimit is the longest audio a single streaming recognition request
+// accepts; speech after it is lost.
+const StreamLimit = 60 * time.Second
+
 func (c *Capturer) Capture(ctx context.Context, done <-chan struct{}) (string, error) {
 	client, err := speech.NewClient(ctx)
 	if err != nil {
@@ -66,7 +70,7 @@ func (c *Capturer) Capture(ctx context.Context, done <-chan struct{}) (string, e
 			if int(vol) < idleThreshold {
 				lastNotIdle = time.Now()
 			}
-			if time.Now().Sub(lastNotIdle) > idleTimeout {
+			if c.IdleTimeout > 0 && time.Now().Sub(lastNotIdle) > c.IdleTimeout {
 				log.Printf("Idle for %s; cancelling.", time.Now().Sub(lastNotIdle))
 				cancel()
 			}
@@ -107,7 +111,7 @@ func (c *Capturer) Capture(ctx context.Context, done <-chan struct{}) (string, e
 		if err := resp.Error; err != nil {
 			// Workaround while the API doesn't give a more informative error.
 			if err.Code == 3 || err.Code == 11 {
-				log.Print("WARNING: Speech recognition request exceeded limit of 60 seconds.")
+				log.Printf("WARNING: Speech recognition request exceeded limit of %v.", StreamLimit)
 			}
 			log.Fatalf("Could not recognize: %v", err)
 		}
@@ -17,10 +17,23 @@ import (
 )
 
 type Capturer struct {
+	// IdleTimeout is how long Capture goes on without hearing voice. Zero
+	// disables it, leaving it to done to end the capture.
+	IdleTimeout time.Duration
+
 	consumers map[int64]*consumer
 	mu        sync.RWMutex
+	started   time.Time
+	lastLevel time.Time
+	lastVoice time.Time
+	paused    int
+	exited    error
 }
 
+// levelTimeout is how long gstreamer may go without reporting audio levels
+// before capture is considered dead.
+const levelTimeout = 10 * time.Second
+
 type consumer struct {
 	sound  chan []byte
 	volume chan float64
@@ -28,7 +41,7 @@ type consumer struct {
 }
 
 func NewCapturer(ctx context.Context, device string) (*Capturer, error) {
-	c := &Capturer{consumers: make(map[int64]*consumer)}
+	c := &Capturer{IdleTimeout: idleTimeout, consumers: make(map[int64]*consumer), started: time.Now()}
 
 	args := []string{"-m"}
 	args = append(args, strings.Split(device, " ")...)
@@ -58,9 +71,15 @@ func NewCapturer(ctx context.Context, device string) (*Capturer, error) {
 	}
 
 	go func() {
-		if err := cmd.Wait(); err != nil {
+		err := cmd.Wait()
+		if err != nil {
 			log.Printf("ERROR while running capturer command: %v", err)
+		} else {
+			err = fmt.Errorf("capturer command exited")
 		}
+		c.mu.Lock()
+		c.exited = err
+		c.mu.Unlock()
 	}()
 
 	return c, nil
@@ -99,6 +118,48 @@ func (c *Capturer) Consume() (<-chan []byte, <-chan float64, func()) {
 	return sound, volume, cancel
 }
 
+// Health returns an error if gstreamer has exited or stopped reporting audio
+// levels.
+func (c *Capturer) Health() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.exited != nil {
+		return c.exited
+	}
+	last := c.lastLevel
+	if last.IsZero() {
+		last = c.started
+	}
+	if d := time.Since(last); d > levelTimeout {
+		return fmt.Errorf("no audio levels for %v", d.Round(time.Second))
+	}
+	return nil
+}
+
+// Pause stops passing audio to consumers and tracking voice, e.g. while the
+// bot makes a sound, until the returned function is called.
+func (c *Capturer) Pause() (resume func()) {
+	c.mu.Lock()
+	c.paused++
+	c.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			c.paused--
+			c.mu.Unlock()
+		})
+	}
+}
+
+// LastVoice returns when audio louder than the idle threshold was last heard,
+// or a zero time if it never was.
+func (c *Capturer) LastVoice() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastVoice
+}
+
 func (c *Capturer) consumeVolume(p io.ReadCloser) {
 	scanner := bufio.NewScanner(p)
 	levelParser := regexp.MustCompile(`peak=\(GValueArray\)< -([0-9.]+) >`)
@@ -109,8 +170,17 @@ func (c *Capturer) consumeVolume(p io.ReadCloser) {
 			if err != nil {
 				log.Fatal(err)
 			}
+			c.mu.Lock()
+			c.lastLevel = time.Now()
+			if int(volume) < idleThreshold && c.paused == 0 {
+				c.lastVoice = c.lastLevel
+			}
+			c.mu.Unlock()
 			c.mu.RLock()
 			for _, consumer := range c.consumers {
+				if c.paused > 0 {
+					break
+				}
 				consumer.volume <- volume
 			}
 			c.mu.RUnlock()
@@ -129,6 +199,9 @@ func (c *Capturer) consumeSound(p io.ReadCloser) {
 		if n > 0 {
 			c.mu.RLock()
 			for _, consumer := range c.consumers {
+				if c.paused > 0 {
+					break
+				}
 				consumer.sound <- buf[:n]
 				consumer.file.Write(buf[:n])
 			}
@@ -0,0 +1,131 @@
+package capture
+
+import (
+	"fmt"
+	"time"
+)
+
+// utterance is how recently voice must have been heard for a speaker to be
+// considered mid-utterance.
+var utterance = 1500 * time.Millisecond
+
+// Decision is what Turn.Decide tells the bot to do about a turn.
+type Decision int
+
+const (
+	// Continue means the turn goes on.
+	Continue Decision = iota
+	// Extend means the deadline was reached while the speaker was talking,
+	// and was moved by the grace period.
+	Extend
+	// EndSilence means the speaker has been silent for too long.
+	EndSilence
+	// EndDeadline means the deadline was reached while the speaker was not
+	// talking.
+	EndDeadline
+	// EndMax means the turn reached its maximum length.
+	EndMax
+)
+
+var decisionNames = map[Decision]string{
+	Continue:    "continue",
+	Extend:      "extend",
+	EndSilence:  "silence",
+	EndDeadline: "deadline",
+	EndMax:      "maximum length",
+}
+
+func (d Decision) String() string {
+	if s, ok := decisionNames[d]; ok {
+		return s
+	}
+	return fmt.Sprintf("Decision(%d)", int(d))
+}
+
+// Ended tells whether the turn is over.
+func (d Decision) Ended() bool {
+	return d >= EndSilence
+}
+
+// Turn decides when a speaker's turn ends based on speech activity.
+//
+// The activity is whatever the caller passes to Decide, and Capturer.LastVoice
+// measures it across the whole room rather than for the speaker alone: anyone
+// else on stage talking, such as a protected host, keeps the turn from ending
+// on silence and extends it as if the speaker were talking.
+type Turn struct {
+	Start time.Time
+	// Stage is how long the turn normally lasts.
+	Stage time.Duration
+	// Silence ends the turn early once the speaker has not been heard for
+	// this long, counting from Start. Zero disables it.
+	Silence time.Duration
+	// Grace extends the deadline whenever it is reached while the speaker
+	// is talking. Zero disables it.
+	Grace time.Duration
+	// Max caps the turn including extensions. It defaults to Stage plus
+	// Grace, but no more than StreamLimit unless Stage itself is longer, so
+	// that extensions do not run past what can be transcribed.
+	Max time.Duration
+
+	deadline time.Time
+}
+
+// Deadline returns when the turn ends unless it is extended or ended early.
+func (t *Turn) Deadline() time.Time {
+	if t.deadline.IsZero() {
+		t.deadline = t.Start.Add(t.Stage)
+	}
+	return t.deadline
+}
+
+func (t *Turn) max() time.Time {
+	if t.Max > 0 {
+		return t.Start.Add(t.Max)
+	}
+	max := t.Stage + t.Grace
+	if max > StreamLimit {
+		max = StreamLimit
+	}
+	if max < t.Stage {
+		max = t.Stage
+	}
+	return t.Start.Add(max)
+}
+
+// Decide tells what to do about the turn at now given when voice was last
+// heard, e.g. Capturer.LastVoice, and when to decide again.
+func (t *Turn) Decide(now, lastVoice time.Time) (Decision, time.Time) {
+	if lastVoice.Before(t.Start) {
+		lastVoice = t.Start
+	}
+	deadline, max := t.Deadline(), t.max()
+	if !now.Before(max) {
+		if max.After(t.Start.Add(t.Stage)) || max.Before(deadline) {
+			return EndMax, now
+		}
+		return EndDeadline, now
+	}
+	if t.Silence > 0 && now.Sub(lastVoice) >= t.Silence {
+		return EndSilence, now
+	}
+	decision := Continue
+	if !now.Before(deadline) {
+		if t.Grace <= 0 || now.Sub(lastVoice) >= utterance {
+			return EndDeadline, now
+		}
+		t.deadline = now.Add(t.Grace)
+		if t.deadline.After(max) {
+			t.deadline = max
+		}
+		deadline = t.deadline
+		decision = Extend
+	}
+	next := deadline
+	if t.Silence > 0 {
+		if s := lastVoice.Add(t.Silence); s.Before(next) {
+			next = s
+		}
+	}
+	return decision, next
+}
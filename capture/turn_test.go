@@ -0,0 +1,109 @@
+package capture
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTurnDecide(t *testing.T) {
+	start := time.Date(2021, 3, 9, 18, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	s := time.Second
+	type step struct {
+		now, lastVoice time.Duration // since start; negative lastVoice means never
+		want           Decision
+		next           time.Duration // since start, checked unless the turn ended
+	}
+	for _, tc := range []struct {
+		desc  string
+		turn  Turn
+		steps []step
+	}{
+		{
+			desc:  "continues until the silence timeout",
+			turn:  Turn{Stage: 60 * s, Silence: 10 * s, Grace: 10 * s},
+			steps: []step{{5 * s, 4 * s, Continue, 14 * s}},
+		},
+		{
+			desc:  "ends on silence counted from the start",
+			turn:  Turn{Stage: 60 * s, Silence: 10 * s, Grace: 10 * s},
+			steps: []step{{10 * s, -1, EndSilence, 0}},
+		},
+		{
+			desc:  "ignores silence when disabled",
+			turn:  Turn{Stage: 60 * s, Grace: 10 * s},
+			steps: []step{{30 * s, -1, Continue, 60 * s}},
+		},
+		{
+			desc:  "ends at the deadline when not talking",
+			turn:  Turn{Stage: 30 * s, Grace: 10 * s},
+			steps: []step{{30 * s, 20 * s, EndDeadline, 0}},
+		},
+		{
+			desc:  "ends at the deadline without grace",
+			turn:  Turn{Stage: 30 * s},
+			steps: []step{{30 * s, 30 * s, EndDeadline, 0}},
+		},
+		{
+			desc: "extends while talking and then ends at the maximum",
+			turn: Turn{Stage: 30 * s, Grace: 10 * s},
+			steps: []step{
+				{30 * s, 29 * s, Extend, 40 * s},
+				{35 * s, 35 * s, Continue, 40 * s},
+				{40 * s, 40 * s, EndMax, 0},
+			},
+		},
+		{
+			desc: "extends and ends at the extended deadline",
+			turn: Turn{Stage: 30 * s, Grace: 10 * s, Max: 60 * s},
+			steps: []step{
+				{30 * s, 30 * s, Extend, 40 * s},
+				{40 * s, 37 * s, EndDeadline, 0},
+			},
+		},
+		{
+			desc:  "caps an extension at the maximum",
+			turn:  Turn{Stage: 30 * s, Grace: 10 * s, Max: 35 * s},
+			steps: []step{{30 * s, 30 * s, Extend, 35 * s}},
+		},
+		{
+			desc:  "caps the default maximum at the stream limit",
+			turn:  Turn{Stage: 55 * s, Grace: 10 * s},
+			steps: []step{{StreamLimit, StreamLimit, EndMax, 0}},
+		},
+		{
+			// The maximum is the deadline, so reaching it is not an
+			// extension cut short.
+			desc:  "ends at the deadline when the maximum equals it",
+			turn:  Turn{Stage: StreamLimit, Grace: 10 * s},
+			steps: []step{{StreamLimit, StreamLimit, EndDeadline, 0}},
+		},
+		{
+			desc:  "ends at a maximum before the deadline",
+			turn:  Turn{Stage: 60 * s, Max: 45 * s},
+			steps: []step{{45 * s, 45 * s, EndMax, 0}},
+		},
+		{
+			desc:  "keeps a stage longer than the stream limit",
+			turn:  Turn{Stage: 90 * s, Grace: 10 * s},
+			steps: []step{{StreamLimit, StreamLimit, Continue, 90 * s}},
+		},
+	} {
+		turn := tc.turn
+		turn.Start = start
+		for i, st := range tc.steps {
+			var lastVoice time.Time
+			if st.lastVoice >= 0 {
+				lastVoice = at(st.lastVoice)
+			}
+			got, next := turn.Decide(at(st.now), lastVoice)
+			if got != st.want {
+				t.Errorf("%s: step %d: Decide() = %v, want %v", tc.desc, i, got, st.want)
+				continue
+			}
+			if !got.Ended() && !next.Equal(at(st.next)) {
+				t.Errorf("%s: step %d: next decision at %v, want %v", tc.desc, i, next.Sub(start), st.next)
+			}
+		}
+	}
+}
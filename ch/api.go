@@ -0,0 +1,442 @@
+package ch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type apiUser struct {
+	UserID          int64      `json:"user_id"`
+	Username        string     `json:"username"`
+	Name            string     `json:"name"`
+	FirstName       string     `json:"first_name"`
+	IsSpeaker       bool       `json:"is_speaker"`
+	IsModerator     bool       `json:"is_moderator"`
+	IsNew           bool       `json:"is_new"`
+	Muted           bool       `json:"muted"`
+	RaisedHand      bool       `json:"raised_hand"`
+	HandRaisedAt    *time.Time `json:"hand_raised_at,omitempty"`
+	Position        int        `json:"position,omitempty"`
+	ETASeconds      *float64   `json:"eta_seconds,omitempty"`
+	Blocked         string     `json:"blocked,omitempty"`
+	Protected       bool       `json:"protected,omitempty"`
+	JoinedAt        *time.Time `json:"joined_at,omitempty"`
+	SpeakingSince   *time.Time `json:"speaking_since,omitempty"`
+	SpeakingSeconds float64    `json:"speaking_seconds"`
+	Turns           int        `json:"turns"`
+}
+
+// ETA returns the estimated wait for the stage rounded to seconds, for the
+// page template.
+func (u apiUser) ETA() time.Duration {
+	if u.ETASeconds == nil {
+		return 0
+	}
+	return (time.Duration(*u.ETASeconds * float64(time.Second))).Round(time.Second)
+}
+
+type apiSession struct {
+	Status  string     `json:"status"`
+	Checked *time.Time `json:"checked,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type apiBot struct {
+	State     string     `json:"state"`
+	Channel   string     `json:"channel,omitempty"`
+	Speaker   int64      `json:"speaker,omitempty"`
+	Panel     []int64    `json:"panel,omitempty"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	Remaining float64    `json:"remaining_seconds,omitempty"`
+}
+
+type apiState struct {
+	LastTime      time.Time  `json:"last_time"`
+	UserID        int64      `json:"user_id"`
+	ActiveChannel string     `json:"active_channel"`
+	Channels      []string   `json:"channels"`
+	VoiceActive   bool       `json:"voice_active"`
+	Session       apiSession `json:"session"`
+	Bot           apiBot     `json:"bot"`
+	Health        *Health    `json:"health"`
+}
+
+type apiUserRequest struct {
+	Channel string `json:"channel"`
+	UserID  int64  `json:"user_id"`
+}
+
+type apiQueueRequest struct {
+	Channel  string `json:"channel"`
+	UserID   int64  `json:"user_id"`
+	Position int    `json:"position"`
+}
+
+type apiBanRequest struct {
+	User string `json:"user"`
+	// Seconds is how long the ban lasts; zero bans permanently.
+	Seconds float64 `json:"seconds"`
+	Reason  string  `json:"reason"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// RegisterAPI registers the JSON control API on mux under prefix, e.g.
+// "/ch/api/v1". Read-only endpoints accept GET and take an optional channel
+// query parameter; actions accept POST with a JSON body.
+func (c *Clubhouse) RegisterAPI(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+"/state", apiHandler(http.MethodGet, c.apiState))
+	mux.HandleFunc(prefix+"/roster", apiHandler(http.MethodGet, c.apiRoster))
+	mux.HandleFunc(prefix+"/queue", apiHandler(http.MethodGet, c.apiQueue))
+	mux.HandleFunc(prefix+"/queue/move", apiHandler(http.MethodPost, c.apiQueueMove))
+	mux.HandleFunc(prefix+"/queue/remove", apiHandler(http.MethodPost, c.apiQueueRemove))
+	mux.HandleFunc(prefix+"/rules", c.apiRules)
+	mux.HandleFunc(prefix+"/rules/ban", apiHandler(http.MethodPost, c.apiBan))
+	mux.HandleFunc(prefix+"/rules/unban", apiHandler(http.MethodPost, c.apiRuleUser(func(r *Rules, user string) { r.Bans = removeBans(r.Bans, user) })))
+	mux.HandleFunc(prefix+"/rules/protect", apiHandler(http.MethodPost, c.apiRuleUser(func(r *Rules, user string) {
+		r.Protected = append(removeString(r.Protected, user), user)
+	})))
+	mux.HandleFunc(prefix+"/rules/unprotect", apiHandler(http.MethodPost, c.apiRuleUser(func(r *Rules, user string) { r.Protected = removeString(r.Protected, user) })))
+	mux.HandleFunc(prefix+"/invite", apiHandler(http.MethodPost, c.apiUserAction("invite")))
+	mux.HandleFunc(prefix+"/uninvite", apiHandler(http.MethodPost, c.apiUserAction("uninvite")))
+	mux.HandleFunc(prefix+"/cancel_voice", apiHandler(http.MethodPost, c.apiCancelVoice))
+	mux.HandleFunc(prefix+"/stream", c.apiStream)
+	c.mu.Lock()
+	c.apiPrefix = prefix
+	c.mu.Unlock()
+}
+
+// httpError is returned by API handlers to respond with a given status code.
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &httpError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// apiHandler serves f for requests with the given method.
+func apiHandler(method string, f func(req *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+			return
+		}
+		v, err := f(req)
+		respondAPI(w, v, err)
+	}
+}
+
+func respondAPI(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		code := http.StatusInternalServerError
+		if he, ok := err.(*httpError); ok {
+			code = he.code
+		}
+		writeJSON(w, code, apiError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("ERROR writing API response: %v", err)
+	}
+}
+
+func (c *Clubhouse) apiState(req *http.Request) (interface{}, error) {
+	return c.state(), nil
+}
+
+func (c *Clubhouse) state() *apiState {
+	var s apiState
+	status, checked, err := c.Session.Status()
+	s.Session.Status = status.String()
+	if !checked.IsZero() {
+		s.Session.Checked = &checked
+	}
+	if err != nil {
+		s.Session.Error = err.Error()
+	}
+	s.Channels = c.ChannelIDs()
+	s.Health = c.Health()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.LastTime = c.LastTime
+	s.UserID = c.UserID
+	s.ActiveChannel = c.ChannelID
+	s.VoiceActive = c.VoiceCancelFunc != nil
+	s.Bot = apiBot{State: c.BotStatus.State, Channel: c.BotStatus.Channel, Speaker: c.BotStatus.Speaker, Panel: c.BotStatus.Panel}
+	if d := c.BotStatus.Deadline; !d.IsZero() {
+		s.Bot.Deadline = &d
+		if r := d.Sub(c.clock.Now()); r > 0 {
+			s.Bot.Remaining = r.Seconds()
+		}
+	}
+	return &s
+}
+
+// apiUsers returns users of the given channel for which keep returns true,
+// sorted by ID.
+func (c *Clubhouse) apiUsers(channel string, keep func(*User) bool) ([]apiUser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := c.channel(channel)
+	if ch == nil {
+		return nil, errorf(http.StatusNotFound, "unknown channel")
+	}
+	ch.syncQueue()
+	now := c.clock.Now()
+	users := []apiUser{}
+	for _, u := range ch.Users {
+		if !keep(u) {
+			continue
+		}
+		au := apiUser{
+			UserID:          u.Profile.UserID,
+			Username:        u.Profile.Username,
+			Name:            u.Profile.Name,
+			FirstName:       u.Profile.FirstName,
+			IsSpeaker:       u.Profile.IsSpeaker,
+			IsModerator:     u.Profile.IsModerator,
+			IsNew:           u.Profile.IsNew,
+			Muted:           u.Muted,
+			RaisedHand:      u.RaisedHand,
+			JoinedAt:        timePtr(u.JoinedAt),
+			SpeakingSince:   timePtr(u.SpeakingSince),
+			SpeakingSeconds: u.SpeakingTime(now).Seconds(),
+			Turns:           u.Turns,
+			Protected:       c.rules.protected(u),
+		}
+		if u.RaisedHand {
+			au.HandRaisedAt = timePtr(u.HandRaisedAt)
+			au.Position = ch.position(u.Profile.UserID)
+			au.Blocked = c.blocked(ch.ID, u, now)
+			if eta, ok := c.eta(ch.ID, au.Position); ok {
+				s := eta.Seconds()
+				au.ETASeconds = &s
+			}
+		}
+		users = append(users, au)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	return users, nil
+}
+
+// timePtr returns a pointer to t, or nil if t is zero, for omitempty fields.
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (c *Clubhouse) apiRoster(req *http.Request) (interface{}, error) {
+	return c.roster(req.URL.Query().Get("channel"))
+}
+
+func (c *Clubhouse) roster(channel string) ([]apiUser, error) {
+	return c.apiUsers(channel, func(*User) bool { return true })
+}
+
+func (c *Clubhouse) apiQueue(req *http.Request) (interface{}, error) {
+	return c.queue(req.URL.Query().Get("channel"))
+}
+
+// queue returns users with raised hands in queue order.
+func (c *Clubhouse) queue(channel string) ([]apiUser, error) {
+	users, err := c.apiUsers(channel, func(u *User) bool { return u.RaisedHand })
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(users, func(i, j int) bool { return users[i].Position < users[j].Position })
+	return users, nil
+}
+
+func decodeQueueRequest(req *http.Request) (*apiQueueRequest, error) {
+	var r apiQueueRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		return nil, errorf(http.StatusBadRequest, "could not parse request: %v", err)
+	}
+	if r.UserID == 0 {
+		return nil, errorf(http.StatusBadRequest, "user_id is required")
+	}
+	return &r, nil
+}
+
+// apiQueueMove moves a user to the requested 1-based position in the queue.
+func (c *Clubhouse) apiQueueMove(req *http.Request) (interface{}, error) {
+	r, err := decodeQueueRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.Position < 1 {
+		return nil, errorf(http.StatusBadRequest, "position must be at least 1")
+	}
+	if err := c.MoveInQueue(r.Channel, r.UserID, r.Position); err != nil {
+		return nil, errorf(http.StatusNotFound, "%v", err)
+	}
+	return c.queue(r.Channel)
+}
+
+func (c *Clubhouse) apiQueueRemove(req *http.Request) (interface{}, error) {
+	r, err := decodeQueueRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.RemoveFromQueue(r.Channel, r.UserID); err != nil {
+		return nil, errorf(http.StatusNotFound, "%v", err)
+	}
+	return c.queue(r.Channel)
+}
+
+// apiUserAction returns a handler running one of userActions for the user
+// given in the request body.
+func (c *Clubhouse) apiUserAction(action string) func(req *http.Request) (interface{}, error) {
+	f := userActions[action]
+	return func(req *http.Request) (interface{}, error) {
+		var r apiUserRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			return nil, errorf(http.StatusBadRequest, "could not parse request: %v", err)
+		}
+		if r.UserID == 0 {
+			return nil, errorf(http.StatusBadRequest, "user_id is required")
+		}
+		c.mu.Lock()
+		ch := c.channel(r.Channel)
+		c.mu.Unlock()
+		if ch == nil {
+			return nil, errorf(http.StatusNotFound, "unknown channel")
+		}
+		if err := f(c.API, req.Context(), ch.ID, r.UserID); err != nil {
+			return nil, errorf(http.StatusBadGateway, "could not %s user %d: %v", action, r.UserID, err)
+		}
+		log.Printf("User %d: %s done via API", r.UserID, action)
+		return map[string]interface{}{"channel": ch.ID, "user_id": r.UserID}, nil
+	}
+}
+
+func (c *Clubhouse) apiCancelVoice(req *http.Request) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.VoiceCancelFunc == nil {
+		return nil, errorf(http.StatusConflict, "bot is not speaking")
+	}
+	c.VoiceCancelFunc()
+	return map[string]interface{}{"cancelled": true}, nil
+}
+
+// apiRules returns the rules on GET and replaces them on PUT or POST.
+func (c *Clubhouse) apiRules(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		respondAPI(w, c.Rules(), nil)
+	case http.MethodPut, http.MethodPost:
+		var r Rules
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			respondAPI(w, nil, errorf(http.StatusBadRequest, "could not parse rules: %v", err))
+			return
+		}
+		rules, err := c.UpdateRules(func(old *Rules) error {
+			*old = r
+			return nil
+		})
+		if err != nil {
+			respondAPI(w, nil, errorf(http.StatusBadRequest, "%v", err))
+			return
+		}
+		log.Printf("Rules replaced via API")
+		respondAPI(w, rules, nil)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+	}
+}
+
+func (c *Clubhouse) apiBan(req *http.Request) (interface{}, error) {
+	var r apiBanRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		return nil, errorf(http.StatusBadRequest, "could not parse request: %v", err)
+	}
+	if r.User == "" || r.Seconds < 0 {
+		return nil, errorf(http.StatusBadRequest, "user and a non-negative duration are required")
+	}
+	ban := Ban{User: r.User, Reason: r.Reason}
+	if r.Seconds > 0 {
+		until := c.clock.Now().Add(time.Duration(r.Seconds * float64(time.Second)))
+		ban.Until = &until
+	}
+	rules, err := c.UpdateRules(func(rules *Rules) error {
+		rules.Bans = append(removeBans(rules.Bans, r.User), ban)
+		return nil
+	})
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	log.Printf("User %s banned via API", r.User)
+	return rules, nil
+}
+
+// apiRuleUser returns a handler applying f to the rules for the user given in
+// the request body.
+func (c *Clubhouse) apiRuleUser(f func(r *Rules, user string)) func(req *http.Request) (interface{}, error) {
+	return func(req *http.Request) (interface{}, error) {
+		var r apiBanRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			return nil, errorf(http.StatusBadRequest, "could not parse request: %v", err)
+		}
+		if r.User == "" {
+			return nil, errorf(http.StatusBadRequest, "user is required")
+		}
+		rules, err := c.UpdateRules(func(rules *Rules) error {
+			f(rules, r.User)
+			return nil
+		})
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "%v", err)
+		}
+		log.Printf("Rules for user %s changed via API: %s", r.User, req.URL.Path)
+		return rules, nil
+	}
+}
+
+// sameUser tells whether two user specs name the same user, ignoring case and
+// a leading @ as matchUser does.
+func sameUser(a, b string) bool {
+	trim := func(s string) string { return strings.TrimPrefix(strings.TrimSpace(s), "@") }
+	return strings.EqualFold(trim(a), trim(b))
+}
+
+func removeBans(bans []Ban, user string) []Ban {
+	var kept []Ban
+	for _, b := range bans {
+		if !sameUser(b.User, user) {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+func removeString(list []string, s string) []string {
+	var kept []string
+	for _, v := range list {
+		if !sameUser(v, s) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -4,66 +4,173 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"sync"
-	"text/template"
 	"time"
 
-	"github.com/hpcloud/tail"
+	"github.com/knyar/housebot/auth"
 )
 
 var recordHeaders = []string{"Authorization", "Accept-Language", "CH-Languages", "CH-UserID", "CH-Locale", "CH-AppBuild", "CH-AppVersion", "CH-DeviceId", "User-Agent"}
 
 type User struct {
-	Profile    *pubnubUser
-	RaisedHand bool
+	Profile      *pubnubUser
+	RaisedHand   bool
+	HandRaisedAt time.Time
+	// Muted is set when a moderator mutes the speaker, and cleared when they
+	// leave or rejoin the stage.
+	Muted    bool
+	JoinedAt time.Time
+	// SpeakingSince is when the current turn on stage started, or zero if the
+	// user is not a speaker.
+	SpeakingSince time.Time
+	// SpokeFor is the total time spent on stage in completed turns.
+	SpokeFor time.Duration
+	Turns    int
 }
+
+// setSpeaker records the user getting on or off stage at ts, returning the
+// length of the turn that ended, if any.
+func (u *User) setSpeaker(ts time.Time, speaker bool) time.Duration {
+	u.Profile.IsSpeaker = speaker
+	var turn time.Duration
+	if speaker && u.SpeakingSince.IsZero() {
+		u.SpeakingSince = ts
+		u.Turns++
+		u.Muted = false
+	} else if !speaker && !u.SpeakingSince.IsZero() {
+		if d := ts.Sub(u.SpeakingSince); d > 0 {
+			turn = d
+			u.SpokeFor += d
+		}
+		u.SpeakingSince = time.Time{}
+		u.Muted = false
+	}
+	return turn
+}
+
+// SpeakingTime returns the total time the user has spent on stage as of now,
+// including the current turn.
+func (u *User) SpeakingTime(now time.Time) time.Duration {
+	d := u.SpokeFor
+	if !u.SpeakingSince.IsZero() && now.After(u.SpeakingSince) {
+		d += now.Sub(u.SpeakingSince)
+	}
+	return d
+}
+
+// Channel is the state of a single room, keyed by Clubhouse channel ID.
+type Channel struct {
+	ID       string
+	LastTime time.Time
+	Users    map[int64]*User
+	// Queue holds the users with raised hands in the order they will be
+	// picked, which moderators may change.
+	Queue []int64
+}
+
+// Clubhouse tracks the state of all rooms seen in the log. Methods taking a
+// channel ID treat an empty ID as the active channel, i.e. the one most
+// recently reported by a heartbeat.
 type Clubhouse struct {
-	logfile         *tail.Tail
+	src             Source
+	clock           Clock
+	done            chan struct{}
+	resumeAfter     time.Time
 	LastTime        time.Time
-	RequestHeaders  map[string]string
+	Session         *Session
 	UserID          int64
 	ChannelID       string
-	Users           map[int64]*User
+	Channels        map[string]*Channel
 	VoiceCancelFunc context.CancelFunc
+	BotStatus       BotStatus
+	API             *Client
+	templatePath    string
 	tpl             *template.Template
+	subscribers     map[chan Event]bool
+	watchers        map[chan struct{}]bool
+	apiPrefix       string
+	started         time.Time
+	lastLine        time.Time
+	staleLog        time.Duration
+	stageTime       time.Duration
+	rules           *Rules
+	rulesPath       string
+	turns           *turnLog
+	observers       []func(Event)
+	healthChecks    []*healthCheck
 	mu              sync.Mutex
 }
 
-func New(logfile string) (*Clubhouse, error) {
+func New(src Source, opts ...Option) (*Clubhouse, error) {
 	var err error
 	c := &Clubhouse{
-		RequestHeaders: make(map[string]string),
-		Users:          make(map[int64]*User),
+		src:          src,
+		templatePath: "ch/index.html",
+		clock:        realClock{},
+		done:         make(chan struct{}),
+		Session:      newSession(),
+		Channels:     make(map[string]*Channel),
+		subscribers:  make(map[chan Event]bool),
+		watchers:     make(map[chan struct{}]bool),
+		staleLog:     2 * time.Minute,
+		rules:        &Rules{},
+		turns:        newTurnLog(),
 	}
-	c.tpl, err = template.ParseFiles("ch/index.html")
-	if err != nil {
+	c.API = &Client{
+		BaseURL:    defaultBaseURL,
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+		Session:    c.Session,
+		Retry:      defaultRetryPolicy,
+		limiter:    newLimiter(2, 5),
+		state:      c,
+	}
+	if err := c.Session.Load(""); err != nil {
 		return nil, err
 	}
-
-	c.logfile, err = tail.TailFile(logfile, tail.Config{ReOpen: true, MustExist: true, Follow: true})
+	if clock, ok := src.(Clock); ok {
+		c.clock = clock
+	}
+	c.started = c.clock.Now()
+	c.addDefaultHealthChecks()
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	c.tpl, err = template.ParseFiles(c.templatePath)
 	if err != nil {
 		return nil, err
 	}
 
 	go c.run()
+	go c.monitorHealth(15 * time.Second)
 	return c, nil
 }
 
 func (c *Clubhouse) run() {
+	defer close(c.done)
 	headers := recordHeadersMap()
-	for line := range c.logfile.Lines {
+	for line := range c.src.Lines() {
 		var msg logMessage
-		if err := json.Unmarshal([]byte(line.Text), &msg); err != nil {
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
 			log.Printf("ERROR unmarshaling ch log: %v", err)
 			continue
 		}
-		c.mu.Lock()
 		sec, dec := math.Modf(msg.Ts)
-		c.LastTime = time.Unix(int64(sec), int64(dec*(1e9)))
+		ts := time.Unix(int64(sec), int64(dec*(1e9)))
+		if !ts.After(c.resumeAfter) {
+			continue
+		}
+		c.mu.Lock()
+		c.lastLine = c.clock.Now()
+		c.LastTime = ts
 
 		if msg.Request.Headers["Host"] == "clubhouse.pubnub.com" || msg.Request.Headers["Host"] == "clubhouse.pubnubapi.com" {
 			c.updateIDs(&msg)
@@ -71,43 +178,89 @@ func (c *Clubhouse) run() {
 		}
 
 		if msg.Request.Headers["Host"] == "www.clubhouseapi.com" {
+			harvested := make(map[string]string)
 			for k, v := range msg.Request.Headers {
-				if headers[k] {
-					c.RequestHeaders[k] = v
+				if h, ok := headers[http.CanonicalHeaderKey(k)]; ok {
+					harvested[h] = v
 				}
 			}
+			c.Session.Update(harvested)
 		}
+		c.changed()
 		c.mu.Unlock()
 	}
-	if err := c.logfile.Wait(); err != nil {
-		log.Printf("ERROR: tail: %v", err)
+	if err := c.src.Err(); err != nil {
+		log.Printf("ERROR: log source: %v", err)
 	}
 }
 
-func (c *Clubhouse) User(user int64) *User {
+// Done is closed once the log source is exhausted.
+func (c *Clubhouse) Done() <-chan struct{} {
+	return c.done
+}
+
+// channel returns the state of the given channel, or nil if it is unknown.
+// It must be called with c.mu held.
+func (c *Clubhouse) channel(id string) *Channel {
+	if id == "" {
+		id = c.ChannelID
+	}
+	return c.Channels[id]
+}
+
+// addChannel returns the state of the given channel, creating it if needed.
+// It must be called with c.mu held.
+func (c *Clubhouse) addChannel(id string) *Channel {
+	if ch, ok := c.Channels[id]; ok {
+		return ch
+	}
+	ch := &Channel{ID: id, Users: make(map[int64]*User)}
+	c.Channels[id] = ch
+	return ch
+}
+
+// ChannelIDs returns the IDs of all known channels.
+func (c *Clubhouse) ChannelIDs() []string {
+	var ids []string
+	c.mu.Lock()
+	for id := range c.Channels {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+	sort.Strings(ids)
+	return ids
+}
+
+// ActiveChannel returns the ID of the channel the account is currently in, or
+// "" if it is not known.
+func (c *Clubhouse) ActiveChannel() string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.Users[user]
+	return c.ChannelID
 }
 
-func (c *Clubhouse) Candidates() []int64 {
-	var users []int64
+func (c *Clubhouse) User(channel string, user int64) *User {
 	c.mu.Lock()
-	for _, u := range c.Users {
-		if u.RaisedHand {
-			users = append(users, u.Profile.UserID)
-		}
+	defer c.mu.Unlock()
+	if ch := c.channel(channel); ch != nil {
+		return ch.Users[user]
 	}
-	c.mu.Unlock()
-	return users
+	return nil
+}
+
+// Candidates returns the users of a channel with raised hands in queue order.
+func (c *Clubhouse) Candidates(channel string) []int64 {
+	return c.Queue(channel)
 }
 
-func (c *Clubhouse) Speakers() []int64 {
+func (c *Clubhouse) Speakers(channel string) []int64 {
 	var users []int64
 	c.mu.Lock()
-	for _, u := range c.Users {
-		if u.Profile.IsSpeaker {
-			users = append(users, u.Profile.UserID)
+	if ch := c.channel(channel); ch != nil {
+		for _, u := range ch.Users {
+			if u.Profile.IsSpeaker {
+				users = append(users, u.Profile.UserID)
+			}
 		}
 	}
 	c.mu.Unlock()
@@ -117,43 +270,149 @@ func (c *Clubhouse) Speakers() []int64 {
 func (c *Clubhouse) SetVoiceCancelFunc(cancel context.CancelFunc) {
 	c.mu.Lock()
 	c.VoiceCancelFunc = cancel
+	c.changed()
+	c.mu.Unlock()
+}
+
+// BotStatus describes what the bot is doing, for display on the dashboard.
+type BotStatus struct {
+	State   string
+	Channel string
+	Speaker int64
+	// Panel lists the speakers seated by the bot when several share the
+	// stage.
+	Panel    []int64
+	Deadline time.Time // end of the current speaker's turn, if any
+}
+
+func (c *Clubhouse) SetBotStatus(s BotStatus) {
+	c.mu.Lock()
+	c.BotStatus = s
+	c.changed()
 	c.mu.Unlock()
 }
 
+// userActions are moderation actions that can be triggered from the control page.
+var userActions = map[string]func(*Client, context.Context, string, int64) error{
+	"invite":           (*Client).InviteSpeaker,
+	"uninvite":         (*Client).UninviteSpeaker,
+	"mute":             (*Client).MuteSpeaker,
+	"make_moderator":   (*Client).MakeModerator,
+	"remove_moderator": (*Client).RemoveModerator,
+	"block":            (*Client).BlockFromChannel,
+}
+
+// channelActions are channel-wide actions that can be triggered from the
+// control page.
+var channelActions = map[string]func(*Client, context.Context, string) error{
+	"leave": (*Client).LeaveChannel,
+	"end":   (*Client).EndChannel,
+}
+
 func (c *Clubhouse) HttpRoot(w http.ResponseWriter, req *http.Request) {
-	params := req.URL.Query()
-	if action, ok := params["action"]; ok {
-		if action[0] == "cancel_voice" {
+	if req.Method == http.MethodPost {
+		c.httpAction(w, req)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var session sessionView
+	session.Status, session.Checked, session.Err = c.Session.Status()
+	health := c.Health()
+	queue, _ := c.queue(req.URL.Query().Get("channel"))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.tpl.Execute(w, struct {
+		*Clubhouse
+		Channel       *Channel
+		SessionStatus sessionView
+		APIPrefix     string
+		CSRFToken     string
+		Now           time.Time
+		Health        *Health
+		Queue         []apiUser
+	}{c, c.channel(req.URL.Query().Get("channel")), session, c.apiPrefix, auth.CSRFToken(req), c.clock.Now(), health, queue}); err != nil {
+		log.Printf("ERROR rendering page: %v", err)
+	}
+}
+
+// httpAction performs an action submitted from the page and redirects back.
+func (c *Clubhouse) httpAction(w http.ResponseWriter, req *http.Request) {
+	action := req.PostFormValue("action")
+	channel := req.PostFormValue("channel")
+	back := fmt.Sprintf("%s?channel=%s", req.URL.Path, url.QueryEscape(channel))
+	if action == "cancel_voice" {
+		c.mu.Lock()
+		if c.VoiceCancelFunc != nil {
+			c.VoiceCancelFunc()
+		}
+		c.mu.Unlock()
+	} else if f, ok := channelActions[action]; ok {
+		if err := f(c.API, req.Context(), channel); err != nil {
+			log.Printf("ERROR: could not %s channel %q: %v", action, channel, err)
+		} else {
+			log.Printf("Channel %q: %s done", channel, action)
+		}
+		back = req.URL.Path
+	} else if action == "queue_up" || action == "queue_down" || action == "queue_remove" {
+		userID, err := strconv.ParseInt(req.PostFormValue("user"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not parse user_id: %v", err), http.StatusBadRequest)
+			return
+		}
+		if action == "queue_remove" {
+			err = c.RemoveFromQueue(channel, userID)
+		} else {
 			c.mu.Lock()
-			if c.VoiceCancelFunc != nil {
-				c.VoiceCancelFunc()
+			pos := 0
+			if ch := c.channel(channel); ch != nil {
+				ch.syncQueue()
+				pos = ch.position(userID)
 			}
 			c.mu.Unlock()
-		}
-		if action[0] == "invite" || action[0] == "uninvite" {
-			if user, ok := params["user"]; ok {
-				userID, err := strconv.ParseInt(user[0], 10, 64)
-				if err != nil {
-					log.Printf("ERROR: could not parse invite user_id from: %+v", params)
-				} else {
-					method := fmt.Sprintf("%s_speaker", action[0])
-					if err := c.SpeakerRequest(method, userID); err != nil {
-						log.Printf("ERROR: could not %s user %d: %v", action[0], userID, err)
-					}
-					log.Printf("Speaker %sd: %d", action[0], userID)
-					http.Redirect(w, req, req.URL.Path, http.StatusFound)
-					return
-				}
+			if action == "queue_up" {
+				pos--
+			} else {
+				pos++
 			}
+			err = c.MoveInQueue(channel, userID, pos)
+		}
+		if err != nil {
+			log.Printf("ERROR: could not %s user %d: %v", action, userID, err)
 		}
+	} else if f, ok := userActions[action]; ok {
+		userID, err := strconv.ParseInt(req.PostFormValue("user"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not parse user_id: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := f(c.API, req.Context(), channel, userID); err != nil {
+			log.Printf("ERROR: could not %s user %d: %v", action, userID, err)
+		} else {
+			log.Printf("User %d: %s done", userID, action)
+		}
+	} else {
+		http.Error(w, fmt.Sprintf("unknown action %q", action), http.StatusBadRequest)
+		return
 	}
-	c.tpl.Execute(w, c)
+	http.Redirect(w, req, back, http.StatusSeeOther)
+}
+
+type sessionView struct {
+	Status  SessionStatus
+	Checked time.Time
+	Err     error
 }
 
-func recordHeadersMap() map[string]bool {
-	m := make(map[string]bool)
+// recordHeadersMap maps canonicalized header names to the names used in
+// sessions, since the header case depends on what produced the log.
+func recordHeadersMap() map[string]string {
+	m := make(map[string]string)
 	for _, h := range recordHeaders {
-		m[h] = true
+		m[http.CanonicalHeaderKey(h)] = h
 	}
 	return m
 }
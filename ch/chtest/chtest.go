@@ -0,0 +1,322 @@
+// Package chtest provides an in-process fake of the Clubhouse API for testing
+// code built on package ch without network access.
+package chtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+)
+
+// Profile is a user profile as it appears in pubnub messages.
+type Profile struct {
+	UserID      int64  `json:"user_id"`
+	Name        string `json:"name"`
+	Username    string `json:"username"`
+	FirstName   string `json:"first_name"`
+	IsSpeaker   bool   `json:"is_speaker"`
+	IsModerator bool   `json:"is_moderator"`
+	IsNew       bool   `json:"is_new"`
+}
+
+// Call is an API call received by the fake server.
+type Call struct {
+	Method  string
+	Channel string
+	UserID  int64
+	Header  http.Header
+}
+
+// Server is a fake Clubhouse API. Successful calls that change room state are
+// reflected back by pushing matching pubnub log lines into Source, as if the
+// proxied app had observed them.
+type Server struct {
+	URL     string
+	Source  *ch.MemorySource
+	Channel string
+	UserID  int64
+	// PubNub, if set by UsePubNub, receives room events instead of Source.
+	PubNub *PubNub
+
+	srv      *httptest.Server
+	mu       sync.Mutex
+	calls    []Call
+	failures map[string]int
+	throttle int
+	after    time.Duration
+	expired  bool
+	profiles map[int64]*Profile
+}
+
+// NewServer starts a fake server for a room with the given channel ID, where
+// userID is the account the bot acts as.
+func NewServer(channel string, userID int64) *Server {
+	s := &Server{
+		Source:   ch.NewMemorySource(),
+		Channel:  channel,
+		UserID:   userID,
+		failures: make(map[string]int),
+		profiles: make(map[int64]*Profile),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveAPI))
+	s.URL = s.srv.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+	s.Source.Close()
+	if s.PubNub != nil {
+		s.PubNub.Close()
+	}
+}
+
+// NewClubhouse creates a Clubhouse that reads from the server's log source
+// and sends API calls to it.
+func (s *Server) NewClubhouse(opts ...ch.Option) (*ch.Clubhouse, error) {
+	return s.newClubhouse(s.Source, opts...)
+}
+
+func (s *Server) newClubhouse(src ch.Source, opts ...ch.Option) (*ch.Clubhouse, error) {
+	_, file, _, _ := runtime.Caller(0)
+	opts = append([]ch.Option{
+		ch.WithBaseURL(s.URL),
+		ch.WithHTTPClient(s.srv.Client()),
+		ch.WithTemplate(filepath.Join(filepath.Dir(file), "..", "index.html")),
+	}, opts...)
+	return ch.New(src, opts...)
+}
+
+// Calls returns all API calls received so far.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Fail makes the next n calls to method return an unsuccessful response. A
+// negative n makes all calls fail; zero makes them succeed again.
+func (s *Server) Fail(method string, n int) {
+	s.mu.Lock()
+	s.failures[method] = n
+	s.mu.Unlock()
+}
+
+// Throttle makes the next n calls fail with 429 Too Many Requests and the
+// given Retry-After delay.
+func (s *Server) Throttle(n int, retryAfter time.Duration) {
+	s.mu.Lock()
+	s.throttle = n
+	s.after = retryAfter
+	s.mu.Unlock()
+}
+
+// Expire makes all calls fail with 401 Unauthorized, as if the bot's
+// credentials expired, until it is called with false.
+func (s *Server) Expire(expired bool) {
+	s.mu.Lock()
+	s.expired = expired
+	s.mu.Unlock()
+}
+
+// Connect emits the heartbeat and API traffic that let Clubhouse learn the
+// channel, the bot's user ID and the headers to replay.
+func (s *Server) Connect() {
+	s.Source.Push(logLine("clubhouse.pubnubapi.com",
+		fmt.Sprintf("https://clubhouse.pubnubapi.com/v2/presence/sub-key/sub-c/channel/channel_user.%s.%d/heartbeat", s.Channel, s.UserID),
+		nil, "{}"))
+	s.Source.Push(logLine("www.clubhouseapi.com", "https://www.clubhouseapi.com/api/get_channel", s.Headers(), `{"success": true}`))
+}
+
+// Headers returns the credentials the fake API accepts.
+func (s *Server) Headers() map[string]string {
+	return map[string]string{
+		"Authorization": "Token fake-token",
+		"CH-UserID":     fmt.Sprint(s.UserID),
+		"CH-DeviceId":   "fake-device",
+		"User-Agent":    "chtest",
+	}
+}
+
+// Join adds a user to the room.
+func (s *Server) Join(p Profile) {
+	s.mu.Lock()
+	s.profiles[p.UserID] = &p
+	s.mu.Unlock()
+	s.pubnub(map[string]interface{}{"action": "join_channel", "user_profile": p})
+}
+
+func (s *Server) RaiseHand(user int64) {
+	s.pubnub(map[string]interface{}{"action": "raise_hands", "user_profile": s.profile(user)})
+}
+
+func (s *Server) LowerHand(user int64) {
+	s.pubnub(map[string]interface{}{"action": "unraise_hands", "user_id": user})
+}
+
+func (s *Server) Leave(user int64) {
+	s.mu.Lock()
+	delete(s.profiles, user)
+	s.mu.Unlock()
+	s.pubnub(map[string]interface{}{"action": "leave_channel", "user_id": user})
+}
+
+func (s *Server) profile(user int64) Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.profiles[user]; ok {
+		return *p
+	}
+	return Profile{UserID: user}
+}
+
+func (s *Server) serveAPI(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Channel string `json:"channel"`
+		UserID  int64  `json:"user_id"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	method := strings.TrimPrefix(req.URL.Path, "/api/")
+
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{Method: method, Channel: body.Channel, UserID: body.UserID, Header: req.Header.Clone()})
+	fail := s.failures[method] != 0
+	if s.failures[method] > 0 {
+		s.failures[method]--
+	}
+	expired := s.expired
+	throttled := s.throttle > 0
+	if throttled {
+		s.throttle--
+	}
+	after := s.after
+	s.mu.Unlock()
+
+	if throttled {
+		w.Header().Set("Retry-After", fmt.Sprint(int(after.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	if expired {
+		w.WriteHeader(http.StatusUnauthorized)
+		respond(w, map[string]interface{}{"detail": "Invalid token."})
+		return
+	}
+	if fail {
+		respond(w, map[string]interface{}{"success": false, "error_message": "chtest: configured failure"})
+		return
+	}
+
+	switch method {
+	case "invite_speaker", "uninvite_speaker":
+		s.mu.Lock()
+		p, ok := s.profiles[body.UserID]
+		if ok {
+			p.IsSpeaker = method == "invite_speaker"
+		}
+		s.mu.Unlock()
+		if !ok {
+			respond(w, map[string]interface{}{"success": false, "error_message": "chtest: no such user"})
+			return
+		}
+		if method == "invite_speaker" {
+			s.pubnub(map[string]interface{}{"action": "add_speaker", "user_profile": s.profile(body.UserID)})
+		} else {
+			s.pubnub(map[string]interface{}{"action": "remove_speaker", "user_id": body.UserID})
+		}
+	case "leave_channel", "end_channel":
+		s.pubnub(map[string]interface{}{"action": "leave_channel", "user_id": s.UserID})
+	case "get_channel", "join_channel":
+		var users []Profile
+		s.mu.Lock()
+		for _, p := range s.profiles {
+			users = append(users, *p)
+		}
+		s.mu.Unlock()
+		resp := map[string]interface{}{"success": true, "channel": s.Channel, "users": users}
+		s.mu.Lock()
+		if s.PubNub != nil {
+			resp["pubnub_token"] = PubNubToken
+			resp["pubnub_origin"] = s.PubNub.URL
+			resp["pubnub_heartbeat_value"] = 30
+			resp["pubnub_heartbeat_interval"] = 25
+		}
+		s.mu.Unlock()
+		respond(w, resp)
+		return
+	case "mute_speaker", "make_moderator", "remove_moderator":
+		s.mu.Lock()
+		if p, ok := s.profiles[body.UserID]; ok && method != "mute_speaker" {
+			p.IsModerator = method == "make_moderator"
+		}
+		s.mu.Unlock()
+		s.pubnub(map[string]interface{}{"action": method, "user_id": body.UserID})
+	case "me", "block_from_channel":
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		respond(w, map[string]interface{}{"success": false, "error_message": "chtest: unknown method"})
+		return
+	}
+	respond(w, map[string]interface{}{"success": true})
+}
+
+func respond(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) pubnub(d map[string]interface{}) {
+	d["channel"] = s.Channel
+	s.mu.Lock()
+	p := s.PubNub
+	s.mu.Unlock()
+	if p != nil {
+		p.Publish("channel_all."+s.Channel, d)
+		return
+	}
+	text, err := json.Marshal(map[string]interface{}{"m": []interface{}{map[string]interface{}{"d": d}}})
+	if err != nil {
+		panic(err)
+	}
+	s.Source.Push(logLine("clubhouse.pubnubapi.com",
+		fmt.Sprintf("https://clubhouse.pubnubapi.com/v2/subscribe/sub-c/channel_all.%s/0", s.Channel),
+		nil, string(text)))
+}
+
+func logLine(host, url string, headers map[string]string, response string) string {
+	h := map[string]string{"Host": host}
+	for k, v := range headers {
+		h[k] = v
+	}
+	line, err := json.Marshal(map[string]interface{}{
+		"ts": float64(time.Now().UnixNano()) / 1e9,
+		"request": map[string]interface{}{
+			"method":  "GET",
+			"headers": h,
+			"url":     url,
+			"text":    "",
+		},
+		"response": map[string]interface{}{
+			"status_code": 200,
+			"headers":     map[string]string{},
+			"cookies":     map[string]string{},
+			"text":        response,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(line)
+}
@@ -0,0 +1,197 @@
+package chtest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+)
+
+// PubNubToken is the pubnub auth key handed out by the fake join_channel.
+const PubNubToken = "fake-pubnub-token"
+
+type pubnubEnvelope struct {
+	timetoken int64
+	channel   string
+	d         map[string]interface{}
+}
+
+// PubNub is a fake pubnub server supporting long-poll subscribe and presence
+// heartbeats.
+type PubNub struct {
+	URL string
+	// PollTimeout is how long a subscribe request is held open when there
+	// are no messages.
+	PollTimeout time.Duration
+
+	srv        *httptest.Server
+	mu         sync.Mutex
+	messages   []pubnubEnvelope
+	timetoken  int64
+	updated    chan struct{}
+	heartbeats int
+	failures   int
+	hbFailures int
+}
+
+func NewPubNub() *PubNub {
+	p := &PubNub{PollTimeout: 5 * time.Second, timetoken: 16000000000000000, updated: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/subscribe/", p.serveSubscribe)
+	mux.HandleFunc("/v2/presence/", p.serveHeartbeat)
+	p.srv = httptest.NewServer(mux)
+	p.URL = p.srv.URL
+	return p
+}
+
+func (p *PubNub) Close() {
+	p.srv.Close()
+}
+
+// Publish delivers d to subscribers of the given pubnub channel.
+func (p *PubNub) Publish(channel string, d map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timetoken++
+	p.messages = append(p.messages, pubnubEnvelope{timetoken: p.timetoken, channel: channel, d: d})
+	close(p.updated)
+	p.updated = make(chan struct{})
+}
+
+// Heartbeats returns the number of presence heartbeats received.
+func (p *PubNub) Heartbeats() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.heartbeats
+}
+
+// Fail makes the next n subscribe requests fail with a server error.
+func (p *PubNub) Fail(n int) {
+	p.mu.Lock()
+	p.failures = n
+	p.mu.Unlock()
+}
+
+// FailHeartbeats makes the next n heartbeat requests fail with a server error.
+func (p *PubNub) FailHeartbeats(n int) {
+	p.mu.Lock()
+	p.hbFailures = n
+	p.mu.Unlock()
+}
+
+func (p *PubNub) serveHeartbeat(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("auth") != PubNubToken {
+		http.Error(w, `{"status": 403, "message": "Forbidden"}`, http.StatusForbidden)
+		return
+	}
+	p.mu.Lock()
+	if p.hbFailures > 0 {
+		p.hbFailures--
+		p.mu.Unlock()
+		http.Error(w, "chtest: configured failure", http.StatusInternalServerError)
+		return
+	}
+	p.heartbeats++
+	p.mu.Unlock()
+	respond(w, map[string]interface{}{"status": 200, "message": "OK", "service": "Presence"})
+}
+
+func (p *PubNub) serveSubscribe(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if q.Get("auth") != PubNubToken {
+		http.Error(w, `{"status": 403, "message": "Forbidden"}`, http.StatusForbidden)
+		return
+	}
+	// /v2/subscribe/{sub_key}/{channels}/0
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v2/subscribe/"), "/")
+	if len(parts) != 3 {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	subscribed := make(map[string]bool)
+	for _, c := range strings.Split(parts[1], ",") {
+		subscribed[c] = true
+	}
+	tt, err := strconv.ParseInt(q.Get("tt"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad timetoken", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	if p.failures > 0 {
+		p.failures--
+		p.mu.Unlock()
+		http.Error(w, "chtest: configured failure", http.StatusInternalServerError)
+		return
+	}
+	p.mu.Unlock()
+
+	timeout := time.After(p.PollTimeout)
+	for {
+		p.mu.Lock()
+		current, updated := p.timetoken, p.updated
+		var m []interface{}
+		if tt != 0 {
+			for _, e := range p.messages {
+				if e.timetoken > tt && subscribed[e.channel] {
+					m = append(m, map[string]interface{}{
+						"a": "1", "f": 0, "i": q.Get("uuid"), "k": parts[0], "c": e.channel, "d": e.d,
+						"p": map[string]interface{}{"t": fmt.Sprint(e.timetoken), "r": 1},
+					})
+				}
+			}
+		}
+		p.mu.Unlock()
+		if tt == 0 || len(m) > 0 {
+			if m == nil {
+				m = []interface{}{}
+			}
+			respond(w, map[string]interface{}{"t": map[string]interface{}{"t": fmt.Sprint(current), "r": 1}, "m": m})
+			return
+		}
+		select {
+		case <-updated:
+		case <-timeout:
+			respond(w, map[string]interface{}{"t": map[string]interface{}{"t": fmt.Sprint(current), "r": 1}, "m": []interface{}{}})
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// UsePubNub makes the server deliver room events through a fake pubnub
+// server instead of log lines in Source, and hand it out from join_channel.
+func (s *Server) UsePubNub() *PubNub {
+	p := NewPubNub()
+	s.mu.Lock()
+	s.PubNub = p
+	s.mu.Unlock()
+	return p
+}
+
+// NewPubNubClubhouse creates a Clubhouse that joins the room through the API
+// and subscribes to its events from the fake pubnub server, as the bot does
+// when running without a proxied phone. UsePubNub must be called first.
+func (s *Server) NewPubNubClubhouse(ctx context.Context, opts ...ch.Option) (*ch.Clubhouse, error) {
+	src := ch.NewPubNubSource()
+	club, err := s.newClubhouse(src, opts...)
+	if err != nil {
+		return nil, err
+	}
+	club.Session.Update(s.Headers())
+	cfg, err := club.API.PubNubConfig(ctx, s.Channel)
+	if err != nil {
+		return nil, err
+	}
+	cfg.HTTPClient = s.PubNub.srv.Client()
+	src.Start(ctx, cfg)
+	return club, nil
+}
@@ -0,0 +1,239 @@
+package ch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type channelReq struct {
+	Channel string `json:"channel"`
+}
+
+type channelUserReq struct {
+	Channel string `json:"channel"`
+	UserID  int64  `json:"user_id"`
+}
+
+type apiResponse struct {
+	Success bool `json:"success"`
+}
+
+// ChannelInfo is returned by get_channel and join_channel.
+type ChannelInfo struct {
+	Channel                 string        `json:"channel"`
+	ChannelID               int64         `json:"channel_id"`
+	Topic                   string        `json:"topic"`
+	Users                   []*pubnubUser `json:"users"`
+	PubNubToken             string        `json:"pubnub_token"`
+	PubNubOrigin            string        `json:"pubnub_origin"`
+	PubNubHeartbeatValue    int           `json:"pubnub_heartbeat_value"`
+	PubNubHeartbeatInterval int           `json:"pubnub_heartbeat_interval"`
+}
+
+// clientState provides what the client needs from room state: the channel to
+// default to.
+type clientState interface {
+	resolveChannel(channel string) (string, error)
+}
+
+// Client makes Clubhouse API calls on behalf of the account whose traffic is
+// being observed. Methods taking a channel ID treat an empty ID as the active
+// channel.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Session    *Session
+	Retry      RetryPolicy
+	limiter    *limiter
+	state      clientState
+
+	mu       sync.Mutex
+	failures int
+	lastErr  error
+}
+
+const defaultBaseURL = "https://www.clubhouseapi.com"
+
+func (c *Client) InviteSpeaker(ctx context.Context, channel string, user int64) error {
+	return c.userRequest(ctx, "invite_speaker", channel, user)
+}
+
+func (c *Client) UninviteSpeaker(ctx context.Context, channel string, user int64) error {
+	return c.userRequest(ctx, "uninvite_speaker", channel, user)
+}
+
+func (c *Client) MuteSpeaker(ctx context.Context, channel string, user int64) error {
+	return c.userRequest(ctx, "mute_speaker", channel, user)
+}
+
+func (c *Client) MakeModerator(ctx context.Context, channel string, user int64) error {
+	return c.userRequest(ctx, "make_moderator", channel, user)
+}
+
+func (c *Client) RemoveModerator(ctx context.Context, channel string, user int64) error {
+	return c.userRequest(ctx, "remove_moderator", channel, user)
+}
+
+func (c *Client) BlockFromChannel(ctx context.Context, channel string, user int64) error {
+	return c.userRequest(ctx, "block_from_channel", channel, user)
+}
+
+func (c *Client) JoinChannel(ctx context.Context, channel string) (*ChannelInfo, error) {
+	var info ChannelInfo
+	if err := c.channelRequest(ctx, "join_channel", channel, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) LeaveChannel(ctx context.Context, channel string) error {
+	return c.channelRequest(ctx, "leave_channel", channel, nil)
+}
+
+func (c *Client) GetChannel(ctx context.Context, channel string) (*ChannelInfo, error) {
+	var info ChannelInfo
+	if err := c.channelRequest(ctx, "get_channel", channel, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) EndChannel(ctx context.Context, channel string) error {
+	return c.channelRequest(ctx, "end_channel", channel, nil)
+}
+
+func (c *Client) userRequest(ctx context.Context, method string, channel string, user int64) error {
+	channel, err := c.state.resolveChannel(channel)
+	if err != nil {
+		return fmt.Errorf("cannot make requests: %v", err)
+	}
+	return c.Do(ctx, method, &channelUserReq{Channel: channel, UserID: user}, nil)
+}
+
+func (c *Client) channelRequest(ctx context.Context, method string, channel string, resp interface{}) error {
+	channel, err := c.state.resolveChannel(channel)
+	if err != nil {
+		return fmt.Errorf("cannot make requests: %v", err)
+	}
+	return c.Do(ctx, method, &channelReq{Channel: channel}, resp)
+}
+
+// Do posts a JSON-encoded request to the given API method, checks that the
+// response reports success and decodes it into resp unless resp is nil.
+// Requests are rate limited, and network errors, server errors and throttling
+// responses are retried with backoff according to c.Retry.
+func (c *Client) Do(ctx context.Context, method string, body interface{}, resp interface{}) error {
+	err := c.retry(ctx, method, body, resp)
+	c.mu.Lock()
+	if err != nil {
+		c.failures++
+		c.lastErr = err
+	} else {
+		c.failures = 0
+		c.lastErr = nil
+	}
+	c.mu.Unlock()
+	return err
+}
+
+// Failures returns the number of consecutive failed API calls and the error
+// the last one failed with.
+func (c *Client) Failures() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failures, c.lastErr
+}
+
+func (c *Client) retry(ctx context.Context, method string, body interface{}, resp interface{}) error {
+	for attempt := 1; ; attempt++ {
+		if err := c.limiter.wait(ctx); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		err := c.do(ctx, method, body, resp)
+		retryable, ok := err.(*retryableError)
+		if !ok || attempt >= c.Retry.Attempts || ctx.Err() != nil {
+			return err
+		}
+		delay := c.Retry.backoff(attempt)
+		if retryable.after > delay {
+			delay = retryable.after
+		}
+		log.Printf("WARN: %s attempt %d failed, retrying in %v: %v", method, attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %v (last error: %v)", method, ctx.Err(), err)
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method string, body interface{}, resp interface{}) error {
+	headers, err := c.Session.requestHeaders()
+	if err != nil {
+		return fmt.Errorf("cannot make requests: %v", err)
+	}
+
+	postBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("could not serialize post body: %v", err)
+	}
+
+	url := fmt.Sprintf("%s/api/%s", c.BaseURL, method)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(postBody))
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+	for k, v := range headers {
+		req.Header[k] = []string{v}
+	}
+	req.Header["Content-Type"] = []string{"application/json; charset=utf-8"}
+
+	httpResp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return &retryableError{err: fmt.Errorf("could not send request: %v", err)}
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read body: %v", err)
+	}
+	if httpResp.StatusCode == http.StatusUnauthorized || httpResp.StatusCode == http.StatusForbidden {
+		err := fmt.Errorf("%s: %s", httpResp.Status, strings.TrimSpace(string(respBody)))
+		c.Session.observe(httpResp.StatusCode, err)
+		return err
+	}
+	c.Session.observe(httpResp.StatusCode, nil)
+	if httpResp.StatusCode == http.StatusTooManyRequests {
+		after := retryAfter(httpResp.Header.Get("Retry-After"))
+		if after > 0 {
+			c.limiter.block(time.Now().Add(after))
+		}
+		return &retryableError{err: fmt.Errorf("%s throttled: %s", method, httpResp.Status), after: after}
+	}
+	if httpResp.StatusCode >= 500 {
+		return &retryableError{err: fmt.Errorf("%s failed: %s: %s", method, httpResp.Status, strings.TrimSpace(string(respBody)))}
+	}
+
+	var r apiResponse
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return fmt.Errorf("could not unmarshal response: %v", err)
+	}
+	if !r.Success {
+		return fmt.Errorf("unsuccessful %s response: %s", method, strings.TrimSpace(string(respBody)))
+	}
+	if resp != nil {
+		if err := json.Unmarshal(respBody, resp); err != nil {
+			return fmt.Errorf("could not unmarshal %s response: %v", method, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package ch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+// newClient returns a Clubhouse with credentials accepted by s, retrying
+// calls up to three times with short backoff.
+func newClient(t *testing.T, s *chtest.Server, opts ...ch.Option) *ch.Clubhouse {
+	t.Helper()
+	opts = append([]ch.Option{ch.WithRetryPolicy(ch.RetryPolicy{Attempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})}, opts...)
+	club, err := s.NewClubhouse(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	club.Session.Update(s.Headers())
+	return club
+}
+
+func countCalls(s *chtest.Server, method string) int {
+	n := 0
+	for _, c := range s.Calls() {
+		if c.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRetryAfterThrottling(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club := newClient(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s.Throttle(1, time.Second)
+	start := time.Now()
+	if _, err := club.API.GetChannel(ctx, "chan"); err != nil {
+		t.Fatalf("GetChannel: %v", err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %v, want at least the 1s Retry-After delay", d)
+	}
+	if n := countCalls(s, "get_channel"); n != 2 {
+		t.Errorf("got %d get_channel calls, want 2", n)
+	}
+	if n, _ := club.API.Failures(); n != 0 {
+		t.Errorf("Failures() = %d after a successful retry, want 0", n)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club := newClient(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s.Throttle(5, 0)
+	if _, err := club.API.GetChannel(ctx, "chan"); err == nil {
+		t.Fatal("GetChannel succeeded while throttled")
+	}
+	if n := countCalls(s, "get_channel"); n != 3 {
+		t.Errorf("got %d get_channel calls, want one per attempt", n)
+	}
+	if n, err := club.API.Failures(); n != 1 || err == nil {
+		t.Errorf("Failures() = %d, %v; want 1 with an error", n, err)
+	}
+}
+
+func TestUnsuccessfulResponseNotRetried(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club := newClient(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s.Fail("me", 1)
+	if err := club.API.ValidateSession(ctx); err == nil {
+		t.Fatal("ValidateSession succeeded despite an unsuccessful response")
+	}
+	if n := countCalls(s, "me"); n != 1 {
+		t.Errorf("got %d me calls, want 1", n)
+	}
+	if err := club.API.ValidateSession(ctx); err != nil {
+		t.Fatalf("ValidateSession after the failure: %v", err)
+	}
+	if n, _ := club.API.Failures(); n != 0 {
+		t.Errorf("Failures() = %d after a success, want 0", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club := newClient(t, s, ch.WithRateLimit(20, 2))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The burst goes through at once and the rest at 20 calls per second.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := club.API.ValidateSession(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Errorf("6 calls took %v, want at least 200ms", d)
+	}
+}
@@ -0,0 +1,108 @@
+package ch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+type EventType int
+
+const (
+	HandRaised EventType = iota
+	HandLowered
+	SpeakerAdded
+	SpeakerRemoved
+	UserJoined
+	UserLeft
+	ChannelLeft
+)
+
+var eventNames = map[EventType]string{
+	HandRaised:     "HandRaised",
+	HandLowered:    "HandLowered",
+	SpeakerAdded:   "SpeakerAdded",
+	SpeakerRemoved: "SpeakerRemoved",
+	UserJoined:     "UserJoined",
+	UserLeft:       "UserLeft",
+	ChannelLeft:    "ChannelLeft",
+}
+
+func (t EventType) String() string {
+	if n, ok := eventNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a room state change decoded from the pubnub subscribe stream.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Channel  string
+	UserID   int64
+	Username string
+	Name     string
+	// Turn is the length of the turn on stage that ended, for SpeakerRemoved.
+	Turn time.Duration
+}
+
+// eventBuffer is the number of events kept for a subscriber that is not
+// reading; further events are dropped.
+const eventBuffer = 256
+
+// Subscribe returns a channel receiving all room events until ctx is done, at
+// which point the channel is closed.
+func (c *Clubhouse) Subscribe(ctx context.Context) <-chan Event {
+	events := make(chan Event, eventBuffer)
+	c.mu.Lock()
+	c.subscribers[events] = true
+	c.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		delete(c.subscribers, events)
+		close(events)
+		c.mu.Unlock()
+	}()
+	return events
+}
+
+// emit must be called with c.mu held.
+func (c *Clubhouse) emit(e Event) {
+	c.turns.observe(e)
+	if ch, ok := c.Channels[e.Channel]; ok {
+		if u, ok := ch.Users[e.UserID]; ok {
+			e.Username, e.Name = u.Profile.Username, u.Profile.Name
+		}
+	}
+	for _, f := range c.observers {
+		f(e)
+	}
+	for s := range c.subscribers {
+		select {
+		case s <- e:
+		default:
+			log.Printf("WARN: subscriber is not keeping up; dropping %v event for user %d", e.Type, e.UserID)
+		}
+	}
+}
+
+// Wait blocks until an event for which match returns true is received. It
+// returns false if ctx is done or the events channel is closed first.
+func Wait(ctx context.Context, events <-chan Event, match func(Event) bool) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			if match(e) {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package ch
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HealthCheck reports a problem by returning an error.
+type HealthCheck func() error
+
+type healthCheck struct {
+	name     string
+	critical bool
+	f        HealthCheck
+	failing  bool
+}
+
+type HealthResult struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Health is the outcome of all health checks. The process is healthy unless a
+// critical check fails, and ready to run the room only if all checks pass.
+type Health struct {
+	Healthy bool           `json:"healthy"`
+	Ready   bool           `json:"ready"`
+	Checks  []HealthResult `json:"checks"`
+}
+
+// apiFailureThreshold is the number of consecutive failed API calls after which
+// the API is reported as failing.
+const apiFailureThreshold = 3
+
+// AddHealthCheck registers a check, e.g. of audio capture. A failing critical
+// check makes the process unhealthy; other checks only make it not ready.
+func (c *Clubhouse) AddHealthCheck(name string, critical bool, f HealthCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.healthChecks = append(c.healthChecks, &healthCheck{name: name, critical: critical, f: f})
+}
+
+func (c *Clubhouse) addDefaultHealthChecks() {
+	// Log lines stop while the account is not in a room, which restarting
+	// the bot would not fix, so a stale log only makes the bot not ready.
+	c.AddHealthCheck("log", false, c.checkLog)
+	c.AddHealthCheck("channel", false, func() error {
+		if c.ActiveChannel() == "" {
+			return fmt.Errorf("not in a channel")
+		}
+		return nil
+	})
+	c.AddHealthCheck("credentials", false, func() error {
+		status, _, err := c.Session.Status()
+		switch status {
+		case SessionMissing:
+			return fmt.Errorf("no credentials")
+		case SessionExpired:
+			return fmt.Errorf("credentials expired: %v", err)
+		}
+		return nil
+	})
+	c.AddHealthCheck("api", false, func() error {
+		if n, err := c.API.Failures(); n >= apiFailureThreshold {
+			return fmt.Errorf("last %d API calls failed: %v", n, err)
+		}
+		return nil
+	})
+}
+
+// checkLog fails if no log lines were received for longer than the stale log
+// threshold.
+func (c *Clubhouse) checkLog() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.staleLog <= 0 {
+		return nil
+	}
+	last := c.lastLine
+	if last.IsZero() {
+		last = c.started
+	}
+	if d := c.clock.Now().Sub(last); d > c.staleLog {
+		if c.lastLine.IsZero() {
+			return fmt.Errorf("no log lines received in %v", d.Round(time.Second))
+		}
+		return fmt.Errorf("no log lines for %v", d.Round(time.Second))
+	}
+	return nil
+}
+
+// Health runs all health checks, logging checks that start or stop failing.
+func (c *Clubhouse) Health() *Health {
+	c.mu.Lock()
+	checks := append([]*healthCheck(nil), c.healthChecks...)
+	c.mu.Unlock()
+
+	h := &Health{Healthy: true, Ready: true, Checks: []HealthResult{}}
+	for _, check := range checks {
+		err := check.f()
+		r := HealthResult{Name: check.name, OK: err == nil, Critical: check.critical}
+		if err != nil {
+			r.Error = err.Error()
+			h.Ready = false
+			if check.critical {
+				h.Healthy = false
+			}
+		}
+		h.Checks = append(h.Checks, r)
+
+		c.mu.Lock()
+		if err != nil && !check.failing {
+			log.Printf("WARN: health check %s is failing: %v", check.name, err)
+		} else if err == nil && check.failing {
+			log.Printf("Health check %s recovered", check.name)
+		}
+		check.failing = err != nil
+		c.mu.Unlock()
+	}
+	return h
+}
+
+// monitorHealth runs health checks periodically so that problems are logged
+// even when nobody is polling the endpoints.
+func (c *Clubhouse) monitorHealth(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			c.Health()
+		}
+	}
+}
+
+// withoutErrors returns a copy of h without the errors of failing checks,
+// which may tell more than an unauthenticated client should know.
+func (h *Health) withoutErrors() *Health {
+	out := *h
+	out.Checks = make([]HealthResult, len(h.Checks))
+	for i, r := range h.Checks {
+		r.Error = ""
+		out.Checks[i] = r
+	}
+	return &out
+}
+
+// RegisterHealth registers /healthz and /readyz on mux. They respond with the
+// names and status of the health checks as JSON, with status 503 if the
+// process is unhealthy or not ready, respectively. They are meant to be served
+// without authentication, so errors are left out; they are part of the state
+// served by the API.
+func (c *Clubhouse) RegisterHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		h := c.Health()
+		code := http.StatusOK
+		if !h.Healthy {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, h.withoutErrors())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		h := c.Health()
+		code := http.StatusOK
+		if !h.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, h.withoutErrors())
+	})
+}
@@ -0,0 +1,53 @@
+package ch_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse(ch.WithStaleLog(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mux := http.NewServeMux()
+	club.RegisterHealth(mux)
+
+	// A stale log and missing credentials make the bot not ready, but
+	// restarting it would not help.
+	for path, want := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", path, w.Code, want)
+		}
+		var h ch.Health
+		if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		failing := 0
+		for _, r := range h.Checks {
+			if !r.OK {
+				failing++
+			}
+			if r.Error != "" {
+				t.Errorf("%s: check %s exposes error %q", path, r.Name, r.Error)
+			}
+		}
+		if failing == 0 {
+			t.Errorf("%s: no failing checks in %+v", path, h)
+		}
+	}
+	if h := club.Health(); h.Checks[0].Name != "log" || h.Checks[0].Error == "" {
+		t.Errorf("Health() = %+v, want the log check failing with an error", h)
+	}
+}
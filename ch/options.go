@@ -0,0 +1,94 @@
+package ch
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Option configures a Clubhouse created by New.
+type Option func(*Clubhouse) error
+
+// WithBaseURL makes API calls go to the given base URL instead of the real
+// Clubhouse API.
+func WithBaseURL(url string) Option {
+	return func(c *Clubhouse) error {
+		c.API.BaseURL = url
+		return nil
+	}
+}
+
+// WithHTTPClient makes API calls using the given HTTP client.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Clubhouse) error {
+		c.API.HTTPClient = client
+		return nil
+	}
+}
+
+// WithRateLimit limits API calls to perSecond on average, with bursts of up to
+// burst calls.
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(c *Clubhouse) error {
+		if perSecond <= 0 || burst < 1 {
+			return fmt.Errorf("invalid rate limit: %v per second, burst %d", perSecond, burst)
+		}
+		c.API.limiter = newLimiter(perSecond, burst)
+		return nil
+	}
+}
+
+// WithRetryPolicy sets how failed API calls are retried.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Clubhouse) error {
+		if p.Attempts < 1 {
+			return fmt.Errorf("retry policy needs at least one attempt")
+		}
+		c.API.Retry = p
+		return nil
+	}
+}
+
+// WithCredentials loads API credentials from a JSON file of headers and the
+// environment, and saves harvested headers back to the file.
+func WithCredentials(path string) Option {
+	return func(c *Clubhouse) error {
+		return c.Session.Load(path)
+	}
+}
+
+// WithTemplate sets the path of the control page template.
+func WithTemplate(path string) Option {
+	return func(c *Clubhouse) error {
+		c.templatePath = path
+		return nil
+	}
+}
+
+// WithStageTime sets how long each speaker gets on stage, for estimating how
+// long queued users will wait.
+func WithStageTime(d time.Duration) Option {
+	return func(c *Clubhouse) error {
+		c.stageTime = d
+		return nil
+	}
+}
+
+// WithStaleLog makes the log health check fail when no log lines are received
+// for longer than d. Zero disables the check.
+func WithStaleLog(d time.Duration) Option {
+	return func(c *Clubhouse) error {
+		c.staleLog = d
+		return nil
+	}
+}
+
+// WithObserver calls f for every room event from the start of the log source,
+// e.g. to record them. Unlike subscribers, f never misses events, but it is
+// called with the Clubhouse locked and must not call its methods.
+func WithObserver(f func(Event)) Option {
+	return func(c *Clubhouse) error {
+		c.observers = append(c.observers, f)
+		return nil
+	}
+}
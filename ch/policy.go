@@ -0,0 +1,186 @@
+package ch
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Candidate is a user with a raised hand, as seen by a selection policy.
+type Candidate struct {
+	UserID int64
+	// Position is the 1-based position in the queue.
+	Position     int
+	HandRaisedAt time.Time
+	JoinedAt     time.Time
+	// Turns counts the user's turns on stage in the channel and SpokeFor
+	// the time spent in those that ended, also before they last left.
+	Turns    int
+	SpokeFor time.Duration
+	// IsNew is set by Clubhouse for users who recently joined the app.
+	IsNew bool
+	// Blocked is why the rules keep the user from being picked, if they do.
+	Blocked string
+}
+
+// CandidateInfo returns the users of a channel with raised hands in queue
+// order.
+func (c *Clubhouse) CandidateInfo(channel string) []Candidate {
+	var cands []Candidate
+	c.mu.Lock()
+	if ch := c.channel(channel); ch != nil {
+		ch.syncQueue()
+		now := c.clock.Now()
+		for i, id := range ch.Queue {
+			u := ch.Users[id]
+			k := turnKey{ch.ID, id}
+			cands = append(cands, Candidate{
+				UserID:       id,
+				Position:     i + 1,
+				HandRaisedAt: u.HandRaisedAt,
+				JoinedAt:     u.JoinedAt,
+				Turns:        c.turns.total[k],
+				SpokeFor:     c.turns.spoke[k],
+				IsNew:        u.Profile.IsNew,
+				Blocked:      c.blocked(ch.ID, u, now),
+			})
+		}
+	}
+	c.mu.Unlock()
+	return cands
+}
+
+// Policy picks the next speaker. Select is only called with at least one
+// candidate.
+type Policy interface {
+	Select(cands []Candidate, now time.Time) int64
+}
+
+// Next picks the next speaker of channel according to p among candidates the
+// rules allow, returning false if there are none.
+func (c *Clubhouse) Next(channel string, p Policy) (int64, bool) {
+	var cands []Candidate
+	for _, cand := range c.CandidateInfo(channel) {
+		if cand.Blocked == "" {
+			cands = append(cands, cand)
+		}
+	}
+	if len(cands) == 0 {
+		return 0, false
+	}
+	return p.Select(cands, c.clock.Now()), true
+}
+
+// Policies are the selection policies by name, for command-line flags.
+var Policies = map[string]func() Policy{
+	"random":       func() Policy { return Random{} },
+	"fifo":         func() Policy { return FIFO{} },
+	"least_spoken": func() Policy { return LeastSpoken{} },
+	"weighted":     func() Policy { return Weighted{WaitUnit: time.Minute} },
+	"newcomer":     func() Policy { return Newcomer{Fallback: LeastSpoken{}} },
+}
+
+// ParsePolicy returns the policy with the given name.
+func ParsePolicy(name string) (Policy, error) {
+	if f, ok := Policies[name]; ok {
+		return f(), nil
+	}
+	var names []string
+	for n := range Policies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown selection policy %q; valid policies are %s", name, strings.Join(names, ", "))
+}
+
+func sortFIFO(cands []Candidate) {
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].Position < cands[j].Position })
+}
+
+// Random picks any candidate with equal probability.
+type Random struct{}
+
+func (Random) Select(cands []Candidate, now time.Time) int64 {
+	return cands[rand.Intn(len(cands))].UserID
+}
+
+// FIFO picks whoever is first in the queue, which is whoever raised their hand
+// first unless moderators reordered it.
+type FIFO struct{}
+
+func (FIFO) Select(cands []Candidate, now time.Time) int64 {
+	cands = append([]Candidate(nil), cands...)
+	sortFIFO(cands)
+	return cands[0].UserID
+}
+
+// LeastSpoken picks whoever had the fewest turns, then the least time on
+// stage, and then whoever is first in the queue.
+type LeastSpoken struct{}
+
+func (LeastSpoken) Select(cands []Candidate, now time.Time) int64 {
+	cands = append([]Candidate(nil), cands...)
+	sortFIFO(cands)
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].Turns != cands[j].Turns {
+			return cands[i].Turns < cands[j].Turns
+		}
+		return cands[i].SpokeFor < cands[j].SpokeFor
+	})
+	return cands[0].UserID
+}
+
+// Weighted is a lottery where the chances grow with how long a candidate has
+// waited and shrink with how many turns they had: the weight is one plus the
+// number of WaitUnits waited, divided by one plus the number of turns.
+type Weighted struct {
+	WaitUnit time.Duration
+}
+
+func (w Weighted) Select(cands []Candidate, now time.Time) int64 {
+	weights := make([]float64, len(cands))
+	total := 0.0
+	for i, c := range cands {
+		waited := 0.0
+		if w.WaitUnit > 0 && now.After(c.HandRaisedAt) {
+			waited = float64(now.Sub(c.HandRaisedAt)) / float64(w.WaitUnit)
+		}
+		weights[i] = (1 + waited) / float64(1+c.Turns)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, weight := range weights {
+		if r < weight {
+			return cands[i].UserID
+		}
+		r -= weight
+	}
+	return cands[len(cands)-1].UserID
+}
+
+// Newcomer gives priority to users new to Clubhouse, and then to those who
+// have not spoken in the room yet, picking among them in queue order. Others
+// are only picked when there are no newcomers, using Fallback.
+type Newcomer struct {
+	Fallback Policy
+}
+
+func (n Newcomer) Select(cands []Candidate, now time.Time) int64 {
+	var isNew, notSpoken []Candidate
+	for _, c := range cands {
+		if c.IsNew {
+			isNew = append(isNew, c)
+		} else if c.Turns == 0 {
+			notSpoken = append(notSpoken, c)
+		}
+	}
+	if len(isNew) > 0 {
+		return FIFO{}.Select(isNew, now)
+	}
+	if len(notSpoken) > 0 {
+		return FIFO{}.Select(notSpoken, now)
+	}
+	return n.Fallback.Select(cands, now)
+}
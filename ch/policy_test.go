@@ -0,0 +1,132 @@
+package ch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+func TestPolicySelect(t *testing.T) {
+	now := time.Date(2021, 3, 9, 18, 0, 0, 0, time.UTC)
+	m := time.Minute
+	// cand returns a candidate at a queue position, with hands raised in
+	// queue order.
+	cand := func(id int64, pos int) ch.Candidate {
+		return ch.Candidate{UserID: id, Position: pos, HandRaisedAt: now.Add(-time.Duration(10-pos) * m)}
+	}
+	spoke := func(c ch.Candidate, turns int, d time.Duration) ch.Candidate {
+		c.Turns, c.SpokeFor = turns, d
+		return c
+	}
+	isNew := func(c ch.Candidate) ch.Candidate {
+		c.IsNew = true
+		return c
+	}
+	for _, tc := range []struct {
+		desc   string
+		policy ch.Policy
+		cands  []ch.Candidate
+		want   int64
+	}{
+		{
+			desc:   "fifo picks the first in the queue",
+			policy: ch.FIFO{},
+			cands:  []ch.Candidate{cand(2, 2), cand(3, 3), cand(1, 1)},
+			want:   1,
+		},
+		{
+			desc:   "fifo ignores turns",
+			policy: ch.FIFO{},
+			cands:  []ch.Candidate{spoke(cand(1, 1), 3, 5*m), cand(2, 2)},
+			want:   1,
+		},
+		{
+			desc:   "least spoken picks the fewest turns",
+			policy: ch.LeastSpoken{},
+			cands:  []ch.Candidate{spoke(cand(1, 1), 2, m), spoke(cand(2, 2), 1, 5*m), spoke(cand(3, 3), 3, 0)},
+			want:   2,
+		},
+		{
+			desc:   "least spoken breaks ties on time spoken",
+			policy: ch.LeastSpoken{},
+			cands:  []ch.Candidate{spoke(cand(1, 1), 1, 2*m), spoke(cand(2, 2), 1, m)},
+			want:   2,
+		},
+		{
+			desc:   "least spoken breaks full ties in queue order",
+			policy: ch.LeastSpoken{},
+			cands:  []ch.Candidate{spoke(cand(3, 3), 1, m), spoke(cand(2, 2), 1, m)},
+			want:   2,
+		},
+		{
+			desc:   "newcomer prefers users new to the app in queue order",
+			policy: ch.Newcomer{Fallback: ch.LeastSpoken{}},
+			cands:  []ch.Candidate{cand(1, 1), isNew(spoke(cand(3, 3), 2, m)), isNew(cand(2, 2))},
+			want:   2,
+		},
+		{
+			desc:   "newcomer then prefers users who have not spoken",
+			policy: ch.Newcomer{Fallback: ch.LeastSpoken{}},
+			cands:  []ch.Candidate{spoke(cand(1, 1), 1, 0), cand(3, 3), cand(2, 2)},
+			want:   2,
+		},
+		{
+			desc:   "newcomer falls back when everyone has spoken",
+			policy: ch.Newcomer{Fallback: ch.LeastSpoken{}},
+			cands:  []ch.Candidate{spoke(cand(1, 1), 2, 0), spoke(cand(2, 2), 1, 3*m), spoke(cand(3, 3), 1, m)},
+			want:   3,
+		},
+	} {
+		if got := tc.policy.Select(tc.cands, now); got != tc.want {
+			t.Errorf("%s: Select() = %d, want %d", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestCandidateTurnsSurviveLeaving(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := club.Subscribe(ctx)
+
+	s.Connect()
+	s.Join(chtest.Profile{UserID: 2, Username: "guest"})
+	s.RaiseHand(2)
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == 2 }) {
+		t.Fatal("no HandRaised event")
+	}
+	if err := club.Invite(ctx, "chan", 2, time.Second); err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerAdded && e.UserID == 2 }) {
+		t.Fatal("no SpeakerAdded event")
+	}
+	if err := club.Uninvite(ctx, "chan", 2); err != nil {
+		t.Fatalf("Uninvite: %v", err)
+	}
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerRemoved && e.UserID == 2 }) {
+		t.Fatal("no SpeakerRemoved event")
+	}
+
+	// Leaving the room drops the user from the roster, but not their turns.
+	s.Leave(2)
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.UserLeft && e.UserID == 2 }) {
+		t.Fatal("no UserLeft event")
+	}
+	s.Join(chtest.Profile{UserID: 2, Username: "guest"})
+	s.RaiseHand(2)
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == 2 }) {
+		t.Fatal("no HandRaised event after rejoining")
+	}
+	if cands := club.CandidateInfo("chan"); len(cands) != 1 || cands[0].Turns != 1 || cands[0].SpokeFor <= 0 {
+		t.Errorf("CandidateInfo() after rejoining = %+v, want user 2 with 1 turn and time spoken", cands)
+	}
+}
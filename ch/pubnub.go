@@ -0,0 +1,286 @@
+package ch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knyar/housebot/redact"
+)
+
+const (
+	defaultPubNubOrigin       = "https://clubhouse.pubnubapi.com"
+	defaultPubNubSubscribeKey = "sub-c-a4abea84-9ca3-11ea-8e71-f2b83ac9263d"
+	// pubnubHost is the Host header of synthesized log lines, so that they
+	// are decoded like sniffed pubnub traffic.
+	pubnubHost = "clubhouse.pubnubapi.com"
+)
+
+// PubNubConfig describes a subscription to the pubnub channels of a room.
+type PubNubConfig struct {
+	Origin       string
+	SubscribeKey string
+	// AuthKey is the pubnub_token returned when joining the channel.
+	AuthKey string
+	Channel string
+	UserID  int64
+	// Heartbeat is the presence timeout announced to pubnub, and
+	// HeartbeatInterval is how often presence heartbeats are sent.
+	Heartbeat         time.Duration
+	HeartbeatInterval time.Duration
+	HTTPClient        *http.Client
+	// users is the roster returned when joining, reported as joins once
+	// subscribed since pubnub only delivers changes.
+	users []*pubnubUser
+}
+
+// channels returns the pubnub channels the app subscribes to for a room.
+func (cfg *PubNubConfig) channels() string {
+	return strings.Join([]string{
+		fmt.Sprintf("users.%d", cfg.UserID),
+		fmt.Sprintf("channel_user.%s.%d", cfg.Channel, cfg.UserID),
+		"channel_speakers." + cfg.Channel,
+		"channel_all." + cfg.Channel,
+	}, ",")
+}
+
+// PubNubConfig joins the given channel, or the active one, and returns the
+// configuration for subscribing to its events directly.
+func (c *Client) PubNubConfig(ctx context.Context, channel string) (*PubNubConfig, error) {
+	info, err := c.JoinChannel(ctx, channel)
+	if err != nil {
+		return nil, fmt.Errorf("could not join channel: %v", err)
+	}
+	if info.PubNubToken == "" {
+		return nil, fmt.Errorf("join_channel response has no pubnub_token")
+	}
+	redact.Learn(redact.Token, info.PubNubToken)
+	var userID int64
+	if _, err := fmt.Sscan(c.Session.Header("CH-UserID"), &userID); err != nil {
+		return nil, fmt.Errorf("could not parse CH-UserID: %v", err)
+	}
+	cfg := &PubNubConfig{
+		Origin:            defaultPubNubOrigin,
+		SubscribeKey:      defaultPubNubSubscribeKey,
+		AuthKey:           info.PubNubToken,
+		Channel:           info.Channel,
+		UserID:            userID,
+		Heartbeat:         time.Duration(info.PubNubHeartbeatValue) * time.Second,
+		HeartbeatInterval: time.Duration(info.PubNubHeartbeatInterval) * time.Second,
+		users:             info.Users,
+	}
+	if info.PubNubOrigin != "" {
+		cfg.Origin = info.PubNubOrigin
+		if !strings.Contains(cfg.Origin, "://") {
+			cfg.Origin = "https://" + cfg.Origin
+		}
+	}
+	return cfg, nil
+}
+
+// PubNubSource subscribes to room events with the pubnub long-poll protocol
+// and produces them as mitmdump-formatted log lines, so that the bot can run
+// without a proxied phone. Lines are produced once Start is called.
+type PubNubSource struct {
+	lines chan string
+}
+
+func NewPubNubSource() *PubNubSource {
+	return &PubNubSource{lines: make(chan string)}
+}
+
+func (s *PubNubSource) Lines() <-chan string { return s.lines }
+
+// Err returns nil: the source only ends when the context passed to Start is
+// done, and failed requests are retried.
+func (s *PubNubSource) Err() error { return nil }
+
+// Start subscribes according to cfg until ctx is done.
+func (s *PubNubSource) Start(ctx context.Context, cfg *PubNubConfig) {
+	if cfg.HTTPClient == nil {
+		// Subscribe requests are held open by the server for up to 280s.
+		cfg.HTTPClient = &http.Client{Timeout: 320 * time.Second}
+	}
+	log.Printf("Subscribing to pubnub channels %s at %s", cfg.channels(), cfg.Origin)
+	// Messages are held until the roster is seeded, so that the users they
+	// are about are known.
+	seeded := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.heartbeat(ctx, cfg, seeded)
+	}()
+	go func() {
+		defer wg.Done()
+		s.subscribe(ctx, cfg, seeded)
+	}()
+	go func() {
+		wg.Wait()
+		close(s.lines)
+	}()
+}
+
+// emit sends a synthesized log line for a successful pubnub request.
+func (s *PubNubSource) emit(ctx context.Context, u string, body []byte) {
+	var m logMessage
+	m.Ts = float64(time.Now().UnixNano()) / 1e9
+	m.Request.Method = http.MethodGet
+	m.Request.URL = u
+	m.Request.Headers = map[string]string{"Host": pubnubHost}
+	m.Response.Status = http.StatusOK
+	m.Response.Text = string(body)
+	line, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("ERROR: could not serialize pubnub line: %v", err)
+		return
+	}
+	select {
+	case s.lines <- string(line):
+	case <-ctx.Done():
+	}
+}
+
+func (s *PubNubSource) get(ctx context.Context, cfg *PubNubConfig, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	resp, err := cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (cfg *PubNubConfig) query(extra url.Values) string {
+	q := url.Values{}
+	q.Set("uuid", fmt.Sprint(cfg.UserID))
+	q.Set("auth", cfg.AuthKey)
+	if cfg.Heartbeat > 0 {
+		q.Set("heartbeat", fmt.Sprint(int(cfg.Heartbeat.Seconds())))
+	}
+	for k, v := range extra {
+		q[k] = v
+	}
+	return q.Encode()
+}
+
+func (s *PubNubSource) subscribe(ctx context.Context, cfg *PubNubConfig, seeded <-chan struct{}) {
+	tt, tr := "0", ""
+	backoff := RetryPolicy{Attempts: 1, MinBackoff: time.Second, MaxBackoff: 30 * time.Second}
+	failures := 0
+	for ctx.Err() == nil {
+		extra := url.Values{"tt": {tt}}
+		if tr != "" {
+			extra.Set("tr", tr)
+		}
+		u := fmt.Sprintf("%s/v2/subscribe/%s/%s/0?%s", cfg.Origin, cfg.SubscribeKey, cfg.channels(), cfg.query(extra))
+		body, err := s.get(ctx, cfg, u)
+		var resp struct {
+			T struct {
+				T string `json:"t"`
+				R int    `json:"r"`
+			} `json:"t"`
+			M []json.RawMessage `json:"m"`
+		}
+		if err == nil {
+			if err = json.Unmarshal(body, &resp); err == nil && resp.T.T == "" {
+				err = fmt.Errorf("response has no timetoken")
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			failures++
+			delay := backoff.backoff(failures)
+			log.Printf("WARN: pubnub subscribe failed, retrying in %v: %v", delay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+		failures = 0
+		tt, tr = resp.T.T, fmt.Sprint(resp.T.R)
+		if len(resp.M) > 0 {
+			select {
+			case <-seeded:
+			case <-ctx.Done():
+				return
+			}
+			s.emit(ctx, u, body)
+		}
+	}
+}
+
+// seed reports the initial roster as join_channel messages. It follows the
+// first successful heartbeat, which tells Clubhouse the channel and user IDs
+// that users are only recorded with.
+func (s *PubNubSource) seed(ctx context.Context, cfg *PubNubConfig) {
+	if len(cfg.users) == 0 {
+		return
+	}
+	var m []interface{}
+	for _, u := range cfg.users {
+		m = append(m, map[string]interface{}{"d": map[string]interface{}{"action": "join_channel", "channel": cfg.Channel, "user_profile": u}})
+	}
+	body, err := json.Marshal(map[string]interface{}{"m": m})
+	if err != nil {
+		log.Printf("ERROR: could not serialize roster: %v", err)
+		return
+	}
+	s.emit(ctx, fmt.Sprintf("%s/v2/subscribe/%s/channel_all.%s/0", cfg.Origin, cfg.SubscribeKey, cfg.Channel), body)
+}
+
+func (s *PubNubSource) heartbeat(ctx context.Context, cfg *PubNubConfig, seeded chan<- struct{}) {
+	interval := cfg.HeartbeatInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	u := fmt.Sprintf("%s/v2/presence/sub-key/%s/channel/channel_user.%s.%d/heartbeat?%s",
+		cfg.Origin, cfg.SubscribeKey, cfg.Channel, cfg.UserID, cfg.query(nil))
+	backoff := RetryPolicy{Attempts: 1, MinBackoff: time.Second, MaxBackoff: interval}
+	ok := false
+	for failures := 0; ; {
+		delay := interval
+		if body, err := s.get(ctx, cfg, u); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("WARN: pubnub heartbeat failed: %v", err)
+			}
+			if !ok {
+				// Retry sooner, as the roster waits for a heartbeat.
+				failures++
+				delay = backoff.backoff(failures)
+			}
+		} else {
+			s.emit(ctx, u, body)
+			if !ok {
+				s.seed(ctx, cfg)
+				close(seeded)
+				ok = true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package ch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+func TestPubNubSource(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	p := s.UsePubNub()
+	p.PollTimeout = 500 * time.Millisecond
+	p.FailHeartbeats(1)
+	s.Join(chtest.Profile{UserID: 2, Username: "early"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := make(chan ch.Event, 100)
+	club, err := s.NewPubNubClubhouse(ctx, ch.WithObserver(func(e ch.Event) { events <- e }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := func(desc string, typ ch.EventType, user int64) {
+		t.Helper()
+		if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == typ && e.UserID == user }) {
+			t.Fatalf("no %s event for user %d", desc, user)
+		}
+	}
+
+	// The roster is only reported once a heartbeat succeeds.
+	wait("UserJoined", ch.UserJoined, 2)
+	if p.Heartbeats() == 0 {
+		t.Error("roster reported before a successful heartbeat")
+	}
+
+	s.Join(chtest.Profile{UserID: 3, Username: "late"})
+	wait("UserJoined", ch.UserJoined, 3)
+	s.RaiseHand(3)
+	wait("HandRaised", ch.HandRaised, 3)
+
+	// Messages published while the subscription is failing are delivered
+	// after it reconnects.
+	p.Fail(2)
+	s.RaiseHand(2)
+	wait("HandRaised", ch.HandRaised, 2)
+	s.Join(chtest.Profile{UserID: 4, Username: "offline"})
+	wait("UserJoined", ch.UserJoined, 4)
+
+	if got := club.Candidates("chan"); len(got) != 2 || got[0] != 3 || got[1] != 2 {
+		t.Errorf("Candidates() = %v, want [3 2]", got)
+	}
+}
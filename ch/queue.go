@@ -0,0 +1,149 @@
+package ch
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// enqueue adds a user who raised their hand to the end of the queue. It must
+// be called with c.mu held.
+func (ch *Channel) enqueue(user int64) {
+	for _, id := range ch.Queue {
+		if id == user {
+			return
+		}
+	}
+	ch.Queue = append(ch.Queue, user)
+}
+
+// dequeue removes a user from the queue. It must be called with c.mu held.
+func (ch *Channel) dequeue(user int64) {
+	for i, id := range ch.Queue {
+		if id == user {
+			ch.Queue = append(ch.Queue[:i], ch.Queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// syncQueue makes the queue hold exactly the users with raised hands, keeping
+// the order of those already queued and adding others by hand raise time, e.g.
+// after restoring a snapshot. It must be called with c.mu held.
+func (ch *Channel) syncQueue() {
+	queued := make(map[int64]bool)
+	var q []int64
+	for _, id := range ch.Queue {
+		if u, ok := ch.Users[id]; ok && u.RaisedHand && !queued[id] {
+			q = append(q, id)
+			queued[id] = true
+		}
+	}
+	var missing []*User
+	for id, u := range ch.Users {
+		if u.RaisedHand && !queued[id] {
+			missing = append(missing, u)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if !missing[i].HandRaisedAt.Equal(missing[j].HandRaisedAt) {
+			return missing[i].HandRaisedAt.Before(missing[j].HandRaisedAt)
+		}
+		return missing[i].Profile.UserID < missing[j].Profile.UserID
+	})
+	for _, u := range missing {
+		q = append(q, u.Profile.UserID)
+	}
+	ch.Queue = q
+}
+
+// position returns the 1-based position of a user in the queue, or 0 if the
+// user is not queued. It must be called with c.mu held.
+func (ch *Channel) position(user int64) int {
+	for i, id := range ch.Queue {
+		if id == user {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Queue returns the users of a channel waiting for the stage, in order.
+func (c *Clubhouse) Queue(channel string) []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := c.channel(channel)
+	if ch == nil {
+		return nil
+	}
+	ch.syncQueue()
+	return append([]int64(nil), ch.Queue...)
+}
+
+// ETA estimates how long the user at the given queue position will wait for
+// the stage, assuming speakers are picked in queue order and each gets the
+// stage time set by WithStageTime. It returns false if the stage time is not
+// known. It must be called with c.mu held.
+func (c *Clubhouse) eta(channel string, position int) (time.Duration, bool) {
+	if c.stageTime <= 0 || position < 1 {
+		return 0, false
+	}
+	var current time.Duration
+	if d := c.BotStatus.Deadline; !d.IsZero() && (channel == "" || c.BotStatus.Channel == "" || c.BotStatus.Channel == channel) {
+		if r := d.Sub(c.clock.Now()); r > 0 {
+			current = r
+		}
+	}
+	return current + time.Duration(position-1)*c.stageTime, true
+}
+
+// MoveInQueue moves a queued user to the given 1-based position, or to the
+// nearest valid one.
+func (c *Clubhouse) MoveInQueue(channel string, user int64, position int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := c.channel(channel)
+	if ch == nil {
+		return fmt.Errorf("unknown channel %q", channel)
+	}
+	ch.syncQueue()
+	if ch.position(user) == 0 {
+		return fmt.Errorf("user %d is not in the queue", user)
+	}
+	ch.dequeue(user)
+	i := position - 1
+	if i < 0 {
+		i = 0
+	}
+	if i > len(ch.Queue) {
+		i = len(ch.Queue)
+	}
+	ch.Queue = append(ch.Queue[:i], append([]int64{user}, ch.Queue[i:]...)...)
+	log.Printf("[%s] Moved user %d to position %d in the queue", ch.ID, user, i+1)
+	c.changed()
+	return nil
+}
+
+// RemoveFromQueue drops a user from the queue as if they lowered their hand.
+// This only hides them from the bot: there is no API call to lower someone
+// else's hand, so it stays raised in the app, and they are queued again only
+// once they lower it there and raise it anew.
+func (c *Clubhouse) RemoveFromQueue(channel string, user int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := c.channel(channel)
+	if ch == nil {
+		return fmt.Errorf("unknown channel %q", channel)
+	}
+	u, ok := ch.Users[user]
+	if !ok || !u.RaisedHand {
+		return fmt.Errorf("user %d is not in the queue", user)
+	}
+	u.RaisedHand = false
+	ch.dequeue(user)
+	log.Printf("[%s] Removed user %d from the queue", ch.ID, user)
+	c.emit(Event{Type: HandLowered, Time: c.clock.Now(), Channel: ch.ID, UserID: user})
+	c.changed()
+	return nil
+}
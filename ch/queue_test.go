@@ -0,0 +1,107 @@
+package ch_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+func TestMoveInQueue(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := club.Subscribe(ctx)
+
+	s.Connect()
+	for _, u := range []int64{2, 3, 4} {
+		s.Join(chtest.Profile{UserID: u, Username: fmt.Sprintf("user%d", u)})
+		s.RaiseHand(u)
+		if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == u }) {
+			t.Fatalf("no HandRaised event for user %d", u)
+		}
+	}
+	s.Join(chtest.Profile{UserID: 5, Username: "listener"})
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.UserJoined && e.UserID == 5 }) {
+		t.Fatal("no UserJoined event for user 5")
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		user     int64
+		position int
+		wantErr  bool
+		want     string
+	}{
+		{"moves to the front", 4, 1, false, "[4 2 3]"},
+		{"moves back", 4, 2, false, "[2 4 3]"},
+		{"clamps a position past the end", 2, 10, false, "[4 3 2]"},
+		{"clamps a position before the front", 3, 0, false, "[3 4 2]"},
+		// queue_up and queue_down move users who are not queued from
+		// position 0 to -1 or 1.
+		{"refuses a user who is not queued", 5, -1, true, "[3 4 2]"},
+		{"refuses a user who is not queued to the front", 5, 1, true, "[3 4 2]"},
+		{"refuses an unknown user", 6, 1, true, "[3 4 2]"},
+	} {
+		err := club.MoveInQueue("chan", tc.user, tc.position)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: MoveInQueue(%d, %d) error = %v, want error %v", tc.desc, tc.user, tc.position, err, tc.wantErr)
+		}
+		if got := fmt.Sprint(club.Queue("chan")); got != tc.want {
+			t.Errorf("%s: Queue() = %s, want %s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestRemoveFromQueue(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := club.Subscribe(ctx)
+
+	s.Connect()
+	for _, u := range []int64{2, 3} {
+		s.Join(chtest.Profile{UserID: u, Username: fmt.Sprintf("user%d", u)})
+		s.RaiseHand(u)
+		if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == u }) {
+			t.Fatalf("no HandRaised event for user %d", u)
+		}
+	}
+
+	if err := club.RemoveFromQueue("chan", 2); err != nil {
+		t.Fatalf("RemoveFromQueue: %v", err)
+	}
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandLowered && e.UserID == 2 }) {
+		t.Fatal("no HandLowered event")
+	}
+	if got := club.Queue("chan"); len(got) != 1 || got[0] != 3 {
+		t.Errorf("Queue() after removal = %v, want [3]", got)
+	}
+	if err := club.RemoveFromQueue("chan", 2); err == nil {
+		t.Error("RemoveFromQueue of a user no longer queued succeeded")
+	}
+
+	// Their hand stays raised in the app; lowering and raising it again
+	// queues them at the end.
+	s.LowerHand(2)
+	s.RaiseHand(2)
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == 2 }) {
+		t.Fatal("no HandRaised event after raising the hand again")
+	}
+	if got := club.Queue("chan"); len(got) != 2 || got[0] != 3 || got[1] != 2 {
+		t.Errorf("Queue() after raising the hand again = %v, want [3 2]", got)
+	}
+}
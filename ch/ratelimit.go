@@ -0,0 +1,106 @@
+package ch
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket shared by all API calls. It refills at rate tokens
+// per second up to burst, and can be blocked entirely until a given time when
+// the API asks us to back off.
+type limiter struct {
+	mu           sync.Mutex
+	rate         float64
+	burst        float64
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait blocks until a request may be made.
+func (l *limiter) wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		var delay time.Duration
+		if now.Before(l.blockedUntil) {
+			delay = l.blockedUntil.Sub(now)
+		} else if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		} else {
+			delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		}
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// block stops all requests until the given time.
+func (l *limiter) block(until time.Time) {
+	l.mu.Lock()
+	if until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+	l.mu.Unlock()
+}
+
+// RetryPolicy controls how failed API calls are retried: up to Attempts tries
+// in total, with exponential backoff starting at MinBackoff and capped at
+// MaxBackoff, with random jitter of up to half the delay.
+type RetryPolicy struct {
+	Attempts   int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{Attempts: 4, MinBackoff: 250 * time.Millisecond, MaxBackoff: 10 * time.Second}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.MinBackoff) * math.Pow(2, float64(attempt-1))
+	if d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	return time.Duration(d/2 + rand.Float64()*d/2)
+}
+
+// retryableError marks failures that are worth retrying, optionally with the
+// delay requested by the server.
+type retryableError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// retryAfter parses a Retry-After header given either in seconds or as an
+// HTTP date.
+func retryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
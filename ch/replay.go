@@ -0,0 +1,74 @@
+package ch
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. Clubhouse uses the clock of its source when
+// the source implements it, so that replayed logs are judged by log time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// ReplaySource feeds a recorded log preserving the original spacing between
+// lines, sped up by the given factor. A speed of 0 or less replays as fast as
+// lines are consumed. It implements Clock, reporting the virtual log time.
+type ReplaySource struct {
+	lines chan string
+	err   error
+	speed float64
+
+	mu       sync.Mutex
+	logTime  time.Time // ts of the most recently emitted line
+	wallTime time.Time // when that line was emitted
+}
+
+func NewReplaySource(r io.Reader, speed float64) *ReplaySource {
+	s := &ReplaySource{lines: make(chan string), speed: speed}
+	raw := make(chan string)
+	go func() {
+		s.err = scanLines(r, raw)
+		close(raw)
+	}()
+	go s.run(raw)
+	return s
+}
+
+func (s *ReplaySource) run(raw <-chan string) {
+	var prev time.Time
+	for line := range raw {
+		if ts, ok := lineTime(line); ok {
+			if s.speed > 0 && !prev.IsZero() && ts.After(prev) {
+				time.Sleep(time.Duration(float64(ts.Sub(prev)) / s.speed))
+			}
+			prev = ts
+			s.mu.Lock()
+			s.logTime = ts
+			s.wallTime = time.Now()
+			s.mu.Unlock()
+		}
+		s.lines <- line
+	}
+	close(s.lines)
+}
+
+func (s *ReplaySource) Lines() <-chan string { return s.lines }
+func (s *ReplaySource) Err() error           { return s.err }
+
+func (s *ReplaySource) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logTime.IsZero() {
+		return time.Now()
+	}
+	if s.speed <= 0 {
+		return s.logTime
+	}
+	return s.logTime.Add(time.Duration(float64(time.Since(s.wallTime)) * s.speed))
+}
@@ -1,48 +1,43 @@
 package ch
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"time"
-
-	retry "github.com/avast/retry-go"
 )
 
-type inviteReq struct {
-	Channel string `json:"channel"`
-	UserID  int64  `json:"user_id"`
-}
-
-type apiResponse struct {
-	Success bool `json:"success"`
-}
-
-func (c *Clubhouse) canMakeRequests() error {
-	if c.RequestHeaders["CH-UserID"] == "" {
-		return fmt.Errorf("CH-UserID header is not set")
+func (c *Clubhouse) resolveChannel(channel string) (string, error) {
+	if channel != "" {
+		return channel, nil
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.ChannelID == "" {
-		return fmt.Errorf("ChannelID not set")
+		return "", fmt.Errorf("ChannelID not set")
 	}
-	return nil
+	return c.ChannelID, nil
 }
 
-func (c *Clubhouse) Invite(ctx context.Context, user int64, timeout time.Duration) error {
+func (c *Clubhouse) Invite(ctx context.Context, channel string, user int64, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	if err := retry.Do(func() error { return c.SpeakerRequest("invite_speaker", user) }, retry.Attempts(3)); err != nil {
+	if err := c.API.InviteSpeaker(ctx, channel, user); err != nil {
 		return fmt.Errorf("could not invite speaker: %v", err)
 	}
 	for {
 		c.mu.Lock()
-		if u, ok := c.Users[user]; !ok || u.Profile.IsSpeaker {
+		ch := c.channel(channel)
+		if ch == nil {
+			c.mu.Unlock()
+			return fmt.Errorf("channel %q is gone", channel)
+		}
+		if u, ok := ch.Users[user]; !ok || u.Profile.IsSpeaker {
+			// Users who left before getting on stage are not charged a
+			// turn.
 			if ok {
-				c.Users[user].RaisedHand = false
+				u.RaisedHand = false
+				c.turns.start(ch.ID, user, c.clock.Now())
 			}
 			c.mu.Unlock()
 			break
@@ -50,7 +45,13 @@ func (c *Clubhouse) Invite(ctx context.Context, user int64, timeout time.Duratio
 		c.mu.Unlock()
 		select {
 		case <-ctx.Done():
-			c.Users[user].RaisedHand = false
+			c.mu.Lock()
+			if ch := c.channel(channel); ch != nil {
+				if u, ok := ch.Users[user]; ok {
+					u.RaisedHand = false
+				}
+			}
+			c.mu.Unlock()
 			return fmt.Errorf("Invitiation for user %d expired", user)
 		case <-time.After(50 * time.Millisecond):
 		}
@@ -58,13 +59,19 @@ func (c *Clubhouse) Invite(ctx context.Context, user int64, timeout time.Duratio
 	return nil
 }
 
-func (c *Clubhouse) Uninvite(ctx context.Context, user int64) error {
-	if err := retry.Do(func() error { return c.SpeakerRequest("uninvite_speaker", user) }, retry.Attempts(3)); err != nil {
+func (c *Clubhouse) Uninvite(ctx context.Context, channel string, user int64) error {
+	if err := c.API.UninviteSpeaker(ctx, channel, user); err != nil {
 		return fmt.Errorf("could not uninvite speaker: %v", err)
 	}
 	for {
 		c.mu.Lock()
-		if u, ok := c.Users[user]; !ok || !u.Profile.IsSpeaker {
+		ch := c.channel(channel)
+		if ch == nil {
+			c.mu.Unlock()
+			break
+		}
+		if u, ok := ch.Users[user]; !ok || !u.Profile.IsSpeaker {
+			c.turns.end(ch.ID, user, c.clock.Now())
 			c.mu.Unlock()
 			break
 		}
@@ -78,60 +85,19 @@ func (c *Clubhouse) Uninvite(ctx context.Context, user int64) error {
 	return nil
 }
 
-func (c *Clubhouse) UninviteAll(ctx context.Context, timeout time.Duration) error {
+// UninviteAll removes all speakers but those protected by the rules from
+// stage.
+func (c *Clubhouse) UninviteAll(ctx context.Context, channel string, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	for _, user := range c.Speakers() {
+	for _, user := range c.Speakers(channel) {
+		if c.Protected(channel, user) {
+			continue
+		}
 		log.Printf("Uninviting user %d", user)
-		if err := c.Uninvite(ctx, user); err != nil {
+		if err := c.Uninvite(ctx, channel, user); err != nil {
 			return err
 		}
 	}
 	return nil
 }
-
-func (c *Clubhouse) SpeakerRequest(method string, user int64) error {
-	if method != "invite_speaker" && method != "uninvite_speaker" {
-		return fmt.Errorf("unexpected method: %s", method)
-	}
-	if err := c.canMakeRequests(); err != nil {
-		return fmt.Errorf("cannot make requests: %v", err)
-	}
-
-	postBody, err := json.Marshal(&inviteReq{Channel: c.ChannelID, UserID: user})
-	if err != nil {
-		return fmt.Errorf("could not serialize post body: %v", err)
-	}
-
-	url := fmt.Sprintf("https://www.clubhouseapi.com/api/%s", method)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(postBody))
-	if err != nil {
-		return fmt.Errorf("could not create request: %v", err)
-	}
-	for k, v := range c.RequestHeaders {
-		req.Header[k] = []string{v}
-	}
-	req.Header["Content-Type"] = []string{"application/json; charset=utf-8"}
-
-	client := http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("could not send request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("could not read body: %v", err)
-	}
-
-	var r apiResponse
-	if err := json.Unmarshal(body, &r); err != nil {
-		return fmt.Errorf("could not unmarshal response: %v", err)
-	}
-
-	if !r.Success {
-		return fmt.Errorf("unsuccessful response: %s", string(body))
-	}
-	return nil
-}
@@ -0,0 +1,73 @@
+package ch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+func TestInviteAndUninvite(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := club.Subscribe(ctx)
+
+	s.Connect()
+	s.Join(chtest.Profile{UserID: 2, Username: "first"})
+	s.Join(chtest.Profile{UserID: 3, Username: "second"})
+	s.RaiseHand(2)
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == 2 }) {
+		t.Fatal("no HandRaised event")
+	}
+	for _, u := range []int64{2, 3} {
+		if err := club.Invite(ctx, "chan", u, time.Second); err != nil {
+			t.Fatalf("Invite(%d): %v", u, err)
+		}
+		if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerAdded && e.UserID == u }) {
+			t.Fatalf("no SpeakerAdded event for user %d", u)
+		}
+	}
+	if got := club.Candidates("chan"); len(got) != 0 {
+		t.Errorf("Candidates() after invite = %v, want none", got)
+	}
+
+	if err := club.Uninvite(ctx, "chan", 2); err != nil {
+		t.Fatalf("Uninvite: %v", err)
+	}
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerRemoved && e.UserID == 2 }) {
+		t.Fatal("no SpeakerRemoved event for user 2")
+	}
+	if got := club.Speakers("chan"); len(got) != 1 || got[0] != 3 {
+		t.Errorf("Speakers() after Uninvite = %v, want [3]", got)
+	}
+
+	if err := club.UninviteAll(ctx, "chan", time.Second); err != nil {
+		t.Fatalf("UninviteAll: %v", err)
+	}
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerRemoved && e.UserID == 3 }) {
+		t.Fatal("no SpeakerRemoved event for user 3")
+	}
+	if got := club.Speakers("chan"); len(got) != 0 {
+		t.Errorf("Speakers() after UninviteAll = %v, want none", got)
+	}
+	var invited, uninvited []int64
+	for _, c := range s.Calls() {
+		switch c.Method {
+		case "invite_speaker":
+			invited = append(invited, c.UserID)
+		case "uninvite_speaker":
+			uninvited = append(uninvited, c.UserID)
+		}
+	}
+	if len(invited) != 2 || len(uninvited) != 2 {
+		t.Errorf("invite_speaker calls for %v and uninvite_speaker calls for %v, want two each", invited, uninvited)
+	}
+}
@@ -0,0 +1,263 @@
+package ch
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hpcloud/tail"
+)
+
+// lineTime returns the ts of a log line.
+func lineTime(line string) (time.Time, bool) {
+	var msg struct {
+		Ts float64 `json:"ts"`
+	}
+	if err := json.Unmarshal([]byte(line), &msg); err != nil || msg.Ts <= 0 {
+		return time.Time{}, false
+	}
+	sec, dec := math.Modf(msg.Ts)
+	return time.Unix(int64(sec), int64(dec*(1e9))), true
+}
+
+// segmentSuffix matches the names logrotate gives rotated segments after the
+// live file's name: a number, or a date with dateext, optionally gzipped.
+var segmentSuffix = regexp.MustCompile(`^(?:\.([0-9]+)|-([0-9]{8}))(\.gz)?$`)
+
+type segment struct {
+	path string
+	num  int    // for numbered segments, where higher numbers are older
+	date string // for dated segments, as YYYYMMDD
+}
+
+// Segments returns the rotated segments of the log at path, oldest first.
+// Segments are named like logrotate does, e.g. path.1, path.2.gz or
+// path-20210309.gz; dated segments are taken to be older than numbered ones.
+// Other files, such as path.swp, and the live file itself are not included.
+func Segments(path string) ([]string, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []segment
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(fi.Name(), base) {
+			continue
+		}
+		m := segmentSuffix.FindStringSubmatch(fi.Name()[len(base):])
+		if m == nil {
+			continue
+		}
+		seg := segment{path: filepath.Join(dir, fi.Name()), date: m[2]}
+		if m[1] != "" {
+			if seg.num, err = strconv.Atoi(m[1]); err != nil {
+				continue
+			}
+		}
+		segs = append(segs, seg)
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		a, b := segs[i], segs[j]
+		if (a.date != "") != (b.date != "") {
+			return a.date != ""
+		}
+		if a.date != b.date {
+			return a.date < b.date
+		}
+		return a.num > b.num
+	})
+	paths := make([]string, len(segs))
+	for i, s := range segs {
+		paths[i] = s.path
+	}
+	return paths, nil
+}
+
+// openSegment opens a log segment, decompressing it if it is gzipped.
+func openSegment(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{z, f}, nil
+}
+
+// segmentsReader concatenates log segments.
+type segmentsReader struct {
+	paths []string
+	cur   io.ReadCloser
+}
+
+// OpenSegments returns a reader of all lines in the given log segments, which
+// may be gzipped, in order.
+func OpenSegments(paths []string) io.ReadCloser {
+	return &segmentsReader{paths: paths}
+}
+
+func (r *segmentsReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			var err error
+			if r.cur, err = openSegment(r.paths[0]); err != nil {
+				return 0, err
+			}
+			r.paths = r.paths[1:]
+		}
+		n, err := r.cur.Read(b)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *segmentsReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+type rotatedSource struct {
+	since time.Time
+	lines chan string
+	t     *tail.Tail
+}
+
+// NewRotatedSource reads the rotated segments of the log at path and then
+// follows the live file, skipping lines before since. Segments last written
+// before since are not read at all.
+func NewRotatedSource(path string, since time.Time) (Source, error) {
+	all, err := Segments(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not list segments of %s: %v", path, err)
+	}
+	var segs []string
+	for _, p := range all {
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().Before(since) {
+			continue
+		}
+		segs = append(segs, p)
+	}
+	if len(segs) > 0 {
+		log.Printf("Reading %d rotated log segments before %s", len(segs), path)
+	}
+	t, err := tail.TailFile(path, tail.Config{ReOpen: true, MustExist: true, Follow: true})
+	if err != nil {
+		return nil, err
+	}
+	s := &rotatedSource{since: since, lines: make(chan string), t: t}
+	go s.run(segs)
+	return s, nil
+}
+
+func (s *rotatedSource) run(segs []string) {
+	defer close(s.lines)
+	skipping := !s.since.IsZero()
+	send := func(line string) {
+		if skipping {
+			if ts, ok := lineTime(line); !ok || ts.Before(s.since) {
+				return
+			}
+			skipping = false
+		}
+		s.lines <- line
+	}
+	r := OpenSegments(segs)
+	raw := make(chan string)
+	go func() {
+		if err := scanLines(r, raw); err != nil {
+			log.Printf("ERROR reading rotated log segments: %v", err)
+		}
+		r.Close()
+		close(raw)
+	}()
+	for line := range raw {
+		send(line)
+	}
+	for line := range s.t.Lines {
+		send(line.Text)
+	}
+}
+
+func (s *rotatedSource) Lines() <-chan string { return s.lines }
+func (s *rotatedSource) Err() error           { return s.t.Wait() }
+
+// SkipBefore returns a reader of the log lines in r from the first one logged
+// at or after since, e.g. to replay part of a long log.
+func SkipBefore(r io.Reader, since time.Time) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+		skipping := true
+		for scanner.Scan() {
+			if skipping {
+				if ts, ok := lineTime(scanner.Text()); !ok || ts.Before(since) {
+					continue
+				}
+				skipping = false
+			}
+			if _, err := pw.Write(append(scanner.Bytes(), '\n')); err != nil {
+				return
+			}
+		}
+		pw.CloseWithError(scanner.Err())
+	}()
+	return pr
+}
+
+// ParseSince parses a start time given as RFC 3339, as "2006-01-02 15:04" or
+// "2006-01-02" in local time, or as a duration before now such as "6h".
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not parse time %q", s)
+}
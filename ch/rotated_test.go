@@ -0,0 +1,113 @@
+package ch_test
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+)
+
+func writeSegment(t *testing.T, path, content string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !strings.HasSuffix(path, ".gz") {
+		f.WriteString(content)
+		return
+	}
+	z := gzip.NewWriter(f)
+	z.Write([]byte(content))
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "housebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mitmproxy.log")
+	for _, name := range []string{
+		"mitmproxy.log", "mitmproxy.log.1", "mitmproxy.log.2.gz", "mitmproxy.log.9.gz", "mitmproxy.log.10.gz",
+		"mitmproxy.log-20210309.gz", "mitmproxy.log-20210308",
+		"mitmproxy.log.swp", "mitmproxy.log.pos", "mitmproxy.log.1.gz.tmp", "mitmproxy.log-old", "other.log.1",
+	} {
+		writeSegment(t, filepath.Join(dir, name), name+"\n")
+	}
+	if err := os.Mkdir(filepath.Join(dir, "mitmproxy.log.3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	segs, err := ch.Segments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range segs {
+		got = append(got, filepath.Base(s))
+	}
+	want := []string{"mitmproxy.log-20210308", "mitmproxy.log-20210309.gz", "mitmproxy.log.10.gz", "mitmproxy.log.9.gz", "mitmproxy.log.2.gz", "mitmproxy.log.1"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Segments() = %v, want %v", got, want)
+	}
+
+	r := ch.OpenSegments(append(segs, path))
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Fields(string(data)); strings.Join(lines, " ") != strings.Join(append(want, "mitmproxy.log"), " ") {
+		t.Errorf("OpenSegments read %v", lines)
+	}
+}
+
+func TestSkipBefore(t *testing.T) {
+	start := time.Date(2021, 3, 9, 18, 0, 0, 0, time.UTC)
+	line := func(d time.Duration) string {
+		return fmt.Sprintf(`{"ts": %.3f}`, float64(start.Add(d).UnixNano())/1e9)
+	}
+	in := strings.Join([]string{line(-time.Minute), "not json", line(-time.Millisecond), line(0), "not json", line(-time.Hour), line(time.Minute)}, "\n")
+	data, err := ioutil.ReadAll(ch.SkipBefore(strings.NewReader(in), start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once the start is reached, every line is kept, even out of order.
+	want := strings.Join([]string{line(0), "not json", line(-time.Hour), line(time.Minute)}, "\n") + "\n"
+	if string(data) != want {
+		t.Errorf("SkipBefore() = %q, want %q", data, want)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2021, 3, 9, 18, 30, 0, 0, time.Local)
+	for _, tc := range []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{"", time.Time{}, false},
+		{"6h", now.Add(-6 * time.Hour), false},
+		{"90m", now.Add(-90 * time.Minute), false},
+		{"2021-03-09T18:00:00Z", time.Date(2021, 3, 9, 18, 0, 0, 0, time.UTC), false},
+		{"2021-03-09 18:00", time.Date(2021, 3, 9, 18, 0, 0, 0, time.Local), false},
+		{"2021-03-09", time.Date(2021, 3, 9, 0, 0, 0, 0, time.Local), false},
+		{"yesterday", time.Time{}, true},
+	} {
+		got, err := ch.ParseSince(tc.in, now)
+		if (err != nil) != tc.err || !got.Equal(tc.want) {
+			t.Errorf("ParseSince(%q) = %v, %v; want %v, error %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
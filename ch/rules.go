@@ -0,0 +1,331 @@
+package ch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rules restrict who the bot may pick as the next speaker.
+type Rules struct {
+	// CooldownSeconds is how long after a turn ends the user cannot be
+	// picked again.
+	CooldownSeconds float64 `json:"cooldown_seconds,omitempty"`
+	// MaxTurnsPerHour and MaxTurnsPerSession limit the number of turns a
+	// user gets in the last hour and since the bot started. Zero means no
+	// limit.
+	MaxTurnsPerHour    int   `json:"max_turns_per_hour,omitempty"`
+	MaxTurnsPerSession int   `json:"max_turns_per_session,omitempty"`
+	Bans               []Ban `json:"bans"`
+	// Protected lists users, by ID or username, who are never removed from
+	// stage by the bot and are exempt from cooldowns and turn limits.
+	Protected []string `json:"protected"`
+}
+
+// Ban keeps a user, given by ID or username, from being picked. Bans without
+// an end are permanent.
+type Ban struct {
+	User   string     `json:"user"`
+	Until  *time.Time `json:"until,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+type turnKey struct {
+	channel string
+	user    int64
+}
+
+// turnLog tracks turns per channel and user for enforcing rules. Turns are
+// started and ended both by the bot inviting and uninviting speakers and by
+// room events, whichever comes first, so that each is counted once.
+type turnLog struct {
+	starts  map[turnKey][]time.Time // turn starts within the last hour
+	total   map[turnKey]int
+	spoke   map[turnKey]time.Duration // time on stage in ended turns
+	lastEnd map[turnKey]time.Time
+	since   map[turnKey]time.Time // start of the turn of users on stage
+}
+
+func newTurnLog() *turnLog {
+	return &turnLog{
+		starts:  make(map[turnKey][]time.Time),
+		total:   make(map[turnKey]int),
+		spoke:   make(map[turnKey]time.Duration),
+		lastEnd: make(map[turnKey]time.Time),
+		since:   make(map[turnKey]time.Time),
+	}
+}
+
+// observe updates the turn log from a room event. It must be called with c.mu
+// held.
+func (t *turnLog) observe(e Event) {
+	switch e.Type {
+	case SpeakerAdded:
+		t.start(e.Channel, e.UserID, e.Time)
+	case SpeakerRemoved:
+		t.end(e.Channel, e.UserID, e.Time)
+	}
+}
+
+func (t *turnLog) start(channel string, user int64, now time.Time) {
+	k := turnKey{channel, user}
+	if _, ok := t.since[k]; ok {
+		return
+	}
+	t.since[k] = now
+	t.total[k]++
+	t.starts[k] = append(t.recent(k, now), now)
+}
+
+func (t *turnLog) end(channel string, user int64, now time.Time) {
+	k := turnKey{channel, user}
+	since, onStage := t.since[k]
+	if _, ok := t.lastEnd[k]; ok && !onStage {
+		return
+	}
+	if onStage && now.After(since) {
+		t.spoke[k] += now.Sub(since)
+	}
+	delete(t.since, k)
+	t.lastEnd[k] = now
+}
+
+// turnRecord is the part of the turn log kept for a channel and user in
+// snapshots.
+type turnRecord struct {
+	Channel  string
+	UserID   int64
+	Starts   []time.Time `json:",omitempty"`
+	Total    int
+	SpokeFor time.Duration `json:",omitempty"`
+	LastEnd  *time.Time    `json:",omitempty"`
+	// OnStageSince is the start of the turn of a user on stage.
+	OnStageSince *time.Time `json:",omitempty"`
+}
+
+// records returns the turn log for saving in a snapshot, leaving out turn
+// starts older than an hour before now.
+func (t *turnLog) records(now time.Time) []turnRecord {
+	keys := make(map[turnKey]bool)
+	for k := range t.total {
+		keys[k] = true
+	}
+	for k := range t.lastEnd {
+		keys[k] = true
+	}
+	var records []turnRecord
+	for k := range keys {
+		r := turnRecord{Channel: k.channel, UserID: k.user, Starts: t.recent(k, now), Total: t.total[k], SpokeFor: t.spoke[k]}
+		if end, ok := t.lastEnd[k]; ok {
+			r.LastEnd = &end
+		}
+		if since, ok := t.since[k]; ok {
+			r.OnStageSince = &since
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// restore replaces the turn log with records from a snapshot.
+func (t *turnLog) restore(records []turnRecord) {
+	*t = *newTurnLog()
+	for _, r := range records {
+		k := turnKey{r.Channel, r.UserID}
+		if r.Total > 0 {
+			t.total[k] = r.Total
+		}
+		if len(r.Starts) > 0 {
+			t.starts[k] = r.Starts
+		}
+		if r.SpokeFor > 0 {
+			t.spoke[k] = r.SpokeFor
+		}
+		if r.LastEnd != nil {
+			t.lastEnd[k] = *r.LastEnd
+		}
+		if r.OnStageSince != nil {
+			t.since[k] = *r.OnStageSince
+		}
+	}
+}
+
+// recent returns the turns started for k within an hour before now.
+func (t *turnLog) recent(k turnKey, now time.Time) []time.Time {
+	var recent []time.Time
+	for _, s := range t.starts[k] {
+		if now.Sub(s) < time.Hour {
+			recent = append(recent, s)
+		}
+	}
+	return recent
+}
+
+// matchUser tells whether spec, a user ID or a username with an optional @,
+// refers to u.
+func matchUser(spec string, u *User) bool {
+	spec = strings.TrimSpace(spec)
+	if id, err := strconv.ParseInt(spec, 10, 64); err == nil {
+		return id == u.Profile.UserID
+	}
+	return u.Profile.Username != "" && strings.EqualFold(strings.TrimPrefix(spec, "@"), u.Profile.Username)
+}
+
+func (r *Rules) protected(u *User) bool {
+	for _, p := range r.Protected {
+		if matchUser(p, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocked returns why the rules keep u from being picked in channel at now, or
+// an empty string if they do not. It must be called with c.mu held.
+func (c *Clubhouse) blocked(channel string, u *User, now time.Time) string {
+	r := c.rules
+	for _, b := range r.Bans {
+		if matchUser(b.User, u) && (b.Until == nil || now.Before(*b.Until)) {
+			if b.Until == nil {
+				return "banned"
+			}
+			return fmt.Sprintf("banned for %v", b.Until.Sub(now).Round(time.Second))
+		}
+	}
+	if r.protected(u) {
+		return ""
+	}
+	k := turnKey{channel, u.Profile.UserID}
+	if r.CooldownSeconds > 0 {
+		cooldown := time.Duration(r.CooldownSeconds * float64(time.Second))
+		if end, ok := c.turns.lastEnd[k]; ok && now.Sub(end) < cooldown {
+			return fmt.Sprintf("cooling down for %v", (cooldown - now.Sub(end)).Round(time.Second))
+		}
+	}
+	if r.MaxTurnsPerHour > 0 {
+		if recent := c.turns.recent(k, now); len(recent) >= r.MaxTurnsPerHour {
+			wait := recent[len(recent)-r.MaxTurnsPerHour].Add(time.Hour).Sub(now)
+			return fmt.Sprintf("%d turns in the last hour; wait %v", len(recent), wait.Round(time.Second))
+		}
+	}
+	if r.MaxTurnsPerSession > 0 && c.turns.total[k] >= r.MaxTurnsPerSession {
+		return fmt.Sprintf("had %d turns", c.turns.total[k])
+	}
+	return ""
+}
+
+// Eligible returns the users of a channel who raised their hands and may be
+// picked under the rules, in queue order.
+func (c *Clubhouse) Eligible(channel string) []int64 {
+	var users []int64
+	for _, cand := range c.CandidateInfo(channel) {
+		if cand.Blocked == "" {
+			users = append(users, cand.UserID)
+		}
+	}
+	return users
+}
+
+// Protected tells whether the rules protect a user of channel from being
+// removed from stage.
+func (c *Clubhouse) Protected(channel string, user int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch := c.channel(channel); ch != nil {
+		if u, ok := ch.Users[user]; ok {
+			return c.rules.protected(u)
+		}
+	}
+	return false
+}
+
+// WithRules loads rules from a JSON file, if it exists, and saves them back to
+// it when they are changed through the API.
+func WithRules(path string) Option {
+	return func(c *Clubhouse) error {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			c.rulesPath = path
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read rules: %v", err)
+		}
+		var r Rules
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("could not parse rules from %s: %v", path, err)
+		}
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("invalid rules in %s: %v", path, err)
+		}
+		c.rules = &r
+		c.rulesPath = path
+		log.Printf("Loaded rules from %s: %d bans, %d protected users", path, len(r.Bans), len(r.Protected))
+		return nil
+	}
+}
+
+func (r *Rules) validate() error {
+	if r.CooldownSeconds < 0 || r.MaxTurnsPerHour < 0 || r.MaxTurnsPerSession < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	for _, b := range r.Bans {
+		if strings.TrimSpace(b.User) == "" {
+			return fmt.Errorf("ban without a user")
+		}
+	}
+	return nil
+}
+
+// Rules returns a copy of the current rules.
+func (c *Clubhouse) Rules() Rules {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rules.copy()
+}
+
+func (r *Rules) copy() Rules {
+	cp := *r
+	cp.Bans = append([]Ban{}, r.Bans...)
+	cp.Protected = append([]string{}, r.Protected...)
+	return cp
+}
+
+// UpdateRules changes the rules with f, which is passed a copy, and saves
+// them if they were loaded from a file. Expired bans are dropped.
+func (c *Clubhouse) UpdateRules(f func(r *Rules) error) (Rules, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.rules.copy()
+	if err := f(&r); err != nil {
+		return Rules{}, err
+	}
+	if err := r.validate(); err != nil {
+		return Rules{}, err
+	}
+	now := c.clock.Now()
+	bans := []Ban{}
+	for _, b := range r.Bans {
+		if b.Until == nil || now.Before(*b.Until) {
+			bans = append(bans, b)
+		}
+	}
+	r.Bans = bans
+	if c.rulesPath != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return Rules{}, err
+		}
+		if err := ioutil.WriteFile(c.rulesPath, data, 0644); err != nil {
+			return Rules{}, fmt.Errorf("could not save rules: %v", err)
+		}
+	}
+	c.rules = &r
+	c.changed()
+	return r.copy(), nil
+}
@@ -0,0 +1,225 @@
+package ch_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+func TestTurnLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "housebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rules := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(rules, []byte(`{"max_turns_per_session": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse(ch.WithRules(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := club.Subscribe(ctx)
+
+	s.Connect()
+	s.Join(chtest.Profile{UserID: 2, Username: "guest"})
+	for turn := 1; turn <= 2; turn++ {
+		s.RaiseHand(2)
+		if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == 2 }) {
+			t.Fatal("no HandRaised event")
+		}
+		cands := club.CandidateInfo("chan")
+		if len(cands) != 1 || cands[0].Blocked != "" {
+			t.Fatalf("CandidateInfo() before turn %d = %+v, want user 2 not blocked", turn, cands)
+		}
+		// The turn is seen both by the bot inviting and uninviting and by
+		// room events, and must be counted once.
+		if err := club.Invite(ctx, "chan", 2, time.Second); err != nil {
+			t.Fatalf("Invite: %v", err)
+		}
+		if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerAdded && e.UserID == 2 }) {
+			t.Fatal("no SpeakerAdded event")
+		}
+		if err := club.Uninvite(ctx, "chan", 2); err != nil {
+			t.Fatalf("Uninvite: %v", err)
+		}
+		if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerRemoved && e.UserID == 2 }) {
+			t.Fatal("no SpeakerRemoved event")
+		}
+	}
+	s.RaiseHand(2)
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == 2 }) {
+		t.Fatal("no HandRaised event")
+	}
+	if cands := club.CandidateInfo("chan"); len(cands) != 1 || cands[0].Blocked != "had 2 turns" {
+		t.Errorf("CandidateInfo() after two turns = %+v, want user 2 blocked after 2 turns", cands)
+	}
+	if got := club.Eligible("chan"); len(got) != 0 {
+		t.Errorf("Eligible() = %v, want none", got)
+	}
+}
+
+func TestUninviteAllKeepsProtected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "housebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rules := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(rules, []byte(`{"protected": ["@host"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse(ch.WithRules(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := club.Subscribe(ctx)
+
+	s.Connect()
+	s.Join(chtest.Profile{UserID: 2, Username: "guest"})
+	s.Join(chtest.Profile{UserID: 3, Username: "host"})
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.UserJoined && e.UserID == 3 }) {
+		t.Fatal("no UserJoined event")
+	}
+	for _, u := range []int64{2, 3} {
+		if err := club.Invite(ctx, "chan", u, time.Second); err != nil {
+			t.Fatalf("Invite(%d): %v", u, err)
+		}
+		if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerAdded && e.UserID == u }) {
+			t.Fatalf("no SpeakerAdded event for user %d", u)
+		}
+	}
+
+	if err := club.UninviteAll(ctx, "chan", time.Second); err != nil {
+		t.Fatalf("UninviteAll: %v", err)
+	}
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.SpeakerRemoved && e.UserID == 2 }) {
+		t.Fatal("no SpeakerRemoved event for user 2")
+	}
+	if got := club.Speakers("chan"); len(got) != 1 || got[0] != 3 {
+		t.Errorf("Speakers() = %v, want only the protected user 3", got)
+	}
+	var uninvited []int64
+	for _, c := range s.Calls() {
+		if c.Method == "uninvite_speaker" {
+			uninvited = append(uninvited, c.UserID)
+		}
+	}
+	if len(uninvited) != 1 || uninvited[0] != 2 {
+		t.Errorf("uninvite_speaker calls for %v, want [2]", uninvited)
+	}
+}
+
+func TestCooldownSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "housebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rules := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(rules, []byte(`{"cooldown_seconds": 3600}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(dir, "state.json")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse(ch.WithRules(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := club.Subscribe(ctx)
+	s.Connect()
+	s.Join(chtest.Profile{UserID: 2, Username: "guest"})
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.UserJoined && e.UserID == 2 }) {
+		t.Fatal("no UserJoined event")
+	}
+	if err := club.Invite(ctx, "chan", 2, time.Second); err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	if err := club.Uninvite(ctx, "chan", 2); err != nil {
+		t.Fatalf("Uninvite: %v", err)
+	}
+	if err := club.Save(state); err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := chtest.NewServer("chan", 1)
+	defer s2.Close()
+	club2, err := s2.NewClubhouse(ch.WithRules(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := club2.Restore(state, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	events2 := club2.Subscribe(ctx)
+	s2.Connect()
+	s2.Join(chtest.Profile{UserID: 2, Username: "guest"})
+	s2.RaiseHand(2)
+	if !ch.Wait(ctx, events2, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == 2 }) {
+		t.Fatal("no HandRaised event after restart")
+	}
+	if cands := club2.CandidateInfo("chan"); len(cands) != 1 || !strings.HasPrefix(cands[0].Blocked, "cooling down") {
+		t.Errorf("CandidateInfo() after restart = %+v, want user 2 cooling down", cands)
+	}
+}
+
+func TestRulesAPIMatchesUsernames(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	club.RegisterAPI(mux, "/api")
+	post := func(path, body string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api"+path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	// Users are matched with or without @ and in any case, so undoing a
+	// rule must not depend on how it was written.
+	for _, tc := range []struct {
+		path, body string
+		want       int
+	}{
+		{"/rules/ban", `{"user": "@alice"}`, http.StatusOK},
+		{"/rules/protect", `{"user": "@Bob"}`, http.StatusOK},
+		{"/rules/protect", `{"user": "bob"}`, http.StatusOK},
+		{"/rules/unban", `{"user": "Alice"}`, http.StatusOK},
+		{"/rules/unprotect", `{"user": "BOB"}`, http.StatusOK},
+		{"/rules/ban", `{"user": " "}`, http.StatusBadRequest},
+	} {
+		if got := post(tc.path, tc.body); got != tc.want {
+			t.Errorf("POST %s %s: status %d, want %d", tc.path, tc.body, got, tc.want)
+		}
+	}
+	if r := club.Rules(); len(r.Bans) != 0 || len(r.Protected) != 0 {
+		t.Errorf("Rules() = %+v, want no bans or protected users", r)
+	}
+}
@@ -0,0 +1,241 @@
+package ch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knyar/housebot/redact"
+)
+
+type SessionStatus int
+
+const (
+	// SessionMissing means there are no credentials to make requests with.
+	SessionMissing SessionStatus = iota
+	// SessionUnverified means credentials are present but have not been used.
+	SessionUnverified
+	SessionValid
+	// SessionExpired means the API rejected the credentials.
+	SessionExpired
+)
+
+func (s SessionStatus) String() string {
+	switch s {
+	case SessionMissing:
+		return "missing"
+	case SessionUnverified:
+		return "unverified"
+	case SessionValid:
+		return "valid"
+	case SessionExpired:
+		return "expired"
+	}
+	return fmt.Sprintf("SessionStatus(%d)", int(s))
+}
+
+// Session holds the headers replayed on API calls. They are loaded from a
+// credentials file and the environment, and updated with headers harvested
+// from observed app traffic. Harvested headers are written back to the
+// credentials file so that they survive restarts.
+type Session struct {
+	mu      sync.Mutex
+	headers map[string]string
+	path    string
+	status  SessionStatus
+	checked time.Time
+	err     error
+}
+
+func newSession() *Session {
+	return &Session{headers: make(map[string]string)}
+}
+
+// envName returns the environment variable a header can be set with, e.g.
+// HOUSEBOT_CH_USERID for CH-UserID.
+func envName(header string) string {
+	return "HOUSEBOT_" + strings.ToUpper(strings.Replace(header, "-", "_", -1))
+}
+
+// Load reads headers from a JSON credentials file, if it exists, and then from
+// HOUSEBOT_* environment variables. Later harvested headers are saved to path.
+func (s *Session) Load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not read credentials: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &s.headers); err != nil {
+				return fmt.Errorf("could not parse credentials from %s: %v", path, err)
+			}
+			log.Printf("Loaded %d headers from %s", len(s.headers), path)
+		}
+	}
+	for _, h := range recordHeaders {
+		if v := os.Getenv(envName(h)); v != "" {
+			s.headers[h] = v
+		}
+	}
+	for k, v := range s.headers {
+		learnHeader(k, v)
+	}
+	s.updateStatus()
+	return nil
+}
+
+// Update merges headers, e.g. harvested from app traffic, into the session.
+// A changed Authorization header makes an expired session usable again.
+func (s *Session) Update(headers map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for k, v := range headers {
+		if s.headers[k] != v {
+			if k == "Authorization" && s.status == SessionExpired {
+				log.Printf("Got new Authorization header; session is no longer expired")
+				s.status = SessionUnverified
+			}
+			s.headers[k] = v
+			learnHeader(k, v)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	s.updateStatus()
+	if s.path != "" {
+		if err := s.save(); err != nil {
+			log.Printf("ERROR saving credentials: %v", err)
+		}
+	}
+}
+
+// learnHeader makes log redaction mask credentials wherever they appear.
+func learnHeader(k, v string) {
+	switch http.CanonicalHeaderKey(k) {
+	case "Authorization":
+		redact.Learn(redact.Token, v)
+		redact.Learn(redact.Token, strings.TrimPrefix(v, "Token "))
+	case "Ch-Deviceid":
+		redact.Learn(redact.DeviceID, v)
+	}
+}
+
+// save must be called with s.mu held.
+func (s *Session) save() error {
+	data, err := json.MarshalIndent(s.headers, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// updateStatus must be called with s.mu held.
+func (s *Session) updateStatus() {
+	if s.headers["CH-UserID"] == "" || s.headers["Authorization"] == "" {
+		s.status = SessionMissing
+	} else if s.status == SessionMissing {
+		s.status = SessionUnverified
+	}
+}
+
+func (s *Session) Header(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.headers[name]
+}
+
+// Headers returns a copy of all session headers.
+func (s *Session) Headers() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	headers := make(map[string]string)
+	for k, v := range s.headers {
+		headers[k] = v
+	}
+	return headers
+}
+
+// HeaderNames returns the names of the session headers, sorted, for display
+// without exposing their values.
+func (s *Session) HeaderNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for k := range s.headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Status returns the session status, when it was last determined by an API
+// call and the error that call failed with, if any.
+func (s *Session) Status() (SessionStatus, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status, s.checked, s.err
+}
+
+// requestHeaders returns headers for an API call, failing early if the
+// session cannot be used.
+func (s *Session) requestHeaders() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.status {
+	case SessionMissing:
+		return nil, fmt.Errorf("no credentials: CH-UserID or Authorization header is not set")
+	case SessionExpired:
+		return nil, fmt.Errorf("credentials expired: %v", s.err)
+	}
+	headers := make(map[string]string)
+	for k, v := range s.headers {
+		headers[k] = v
+	}
+	return headers, nil
+}
+
+// observe records the outcome of an authenticated API call.
+func (s *Session) observe(code int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checked = time.Now()
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		if s.status != SessionExpired {
+			log.Printf("ERROR: Clubhouse credentials expired: %v", err)
+		}
+		s.status = SessionExpired
+		s.err = err
+		return
+	}
+	if code >= 200 && code < 300 {
+		s.status = SessionValid
+		s.err = nil
+	}
+}
+
+// ValidateSession makes a cheap authenticated call to check that the session
+// credentials are accepted.
+func (c *Client) ValidateSession(ctx context.Context) error {
+	if err := c.Do(ctx, "me", map[string]interface{}{"return_blocked_ids": false, "return_following_ids": false}, nil); err != nil {
+		return fmt.Errorf("could not validate session: %v", err)
+	}
+	return nil
+}
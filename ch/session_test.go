@@ -0,0 +1,72 @@
+package ch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+func TestSessionExpiry(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	status := func() ch.SessionStatus {
+		st, _, _ := club.Session.Status()
+		return st
+	}
+
+	if st := status(); st != ch.SessionMissing {
+		t.Errorf("status without headers = %v, want missing", st)
+	}
+	club.Session.Update(s.Headers())
+	if st := status(); st != ch.SessionUnverified {
+		t.Errorf("status with headers = %v, want unverified", st)
+	}
+	if err := club.API.ValidateSession(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st := status(); st != ch.SessionValid {
+		t.Errorf("status after a call = %v, want valid", st)
+	}
+
+	s.Expire(true)
+	if err := club.API.ValidateSession(ctx); err == nil {
+		t.Fatal("ValidateSession succeeded with expired credentials")
+	}
+	if st := status(); st != ch.SessionExpired {
+		t.Errorf("status after 401 = %v, want expired", st)
+	}
+	// Expired credentials are not used again.
+	calls := len(s.Calls())
+	if err := club.API.ValidateSession(ctx); err == nil {
+		t.Fatal("ValidateSession succeeded with expired credentials")
+	}
+	if n := len(s.Calls()); n != calls {
+		t.Errorf("%d calls made with expired credentials", n-calls)
+	}
+
+	// Only a new token makes the session usable again.
+	s.Expire(false)
+	club.Session.Update(s.Headers())
+	if st := status(); st != ch.SessionExpired {
+		t.Errorf("status after the same headers = %v, want expired", st)
+	}
+	club.Session.Update(map[string]string{"Authorization": "Token renewed"})
+	if st := status(); st != ch.SessionUnverified {
+		t.Errorf("status after a new token = %v, want unverified", st)
+	}
+	if err := club.API.ValidateSession(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if st := status(); st != ch.SessionValid {
+		t.Errorf("status after renewal = %v, want valid", st)
+	}
+}
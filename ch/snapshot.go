@@ -0,0 +1,118 @@
+package ch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+type snapshot struct {
+	LastTime  time.Time
+	UserID    int64
+	ChannelID string
+	Channels  map[string]*Channel
+	// Turns keeps cooldowns and turn limits across restarts.
+	Turns []turnRecord `json:",omitempty"`
+}
+
+// WithStateFile restores state saved in path on startup, unless the snapshot
+// is older than maxAge, and then saves state there every interval. Log lines
+// already covered by the restored snapshot are skipped.
+func WithStateFile(path string, interval, maxAge time.Duration) Option {
+	return func(c *Clubhouse) error {
+		if err := c.Restore(path, maxAge); err != nil {
+			return err
+		}
+		go func() {
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			for done := false; !done; {
+				select {
+				case <-c.done:
+					done = true
+				case <-t.C:
+				}
+				if err := c.Save(path); err != nil {
+					log.Printf("ERROR saving state: %v", err)
+				}
+			}
+		}()
+		return nil
+	}
+}
+
+// Save writes a snapshot of room state to path. Credentials are not part of
+// the snapshot; they are kept by Session in the credentials file.
+func (c *Clubhouse) Save(path string) error {
+	c.mu.Lock()
+	if c.LastTime.IsZero() {
+		c.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(&snapshot{
+		LastTime:  c.LastTime,
+		UserID:    c.UserID,
+		ChannelID: c.ChannelID,
+		Channels:  c.Channels,
+		Turns:     c.turns.records(c.clock.Now()),
+	}, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not serialize state: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("could not write state: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restore loads a snapshot written by Save. Snapshots older than maxAge, and
+// hands raised more than maxAge ago, are ignored. A missing file is not an
+// error.
+func (c *Clubhouse) Restore(path string, maxAge time.Duration) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("No saved state in %s", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read state: %v", err)
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("could not parse state from %s: %v", path, err)
+	}
+	now := c.clock.Now()
+	if age := now.Sub(s.LastTime); age > maxAge {
+		log.Printf("Ignoring saved state from %s: %v old", path, age)
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range s.Channels {
+		for _, u := range ch.Users {
+			if u.RaisedHand && now.Sub(u.HandRaisedAt) > maxAge {
+				u.RaisedHand = false
+			}
+			if u.Profile != nil {
+				learnProfile(u.Profile)
+			}
+		}
+		ch.syncQueue()
+	}
+	c.LastTime = s.LastTime
+	c.UserID = s.UserID
+	c.ChannelID = s.ChannelID
+	if s.Channels != nil {
+		c.Channels = s.Channels
+	}
+	c.turns.restore(s.Turns)
+	c.resumeAfter = s.LastTime
+	log.Printf("Restored state from %s as of %s: %d channels", path, s.LastTime, len(s.Channels))
+	return nil
+}
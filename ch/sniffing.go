@@ -4,11 +4,12 @@ import (
 	"encoding/json"
 	"log"
 	"math"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/knyar/housebot/redact"
 )
 
 type logMessage struct {
@@ -28,11 +29,16 @@ type logMessage struct {
 }
 
 type pubnubUser struct {
-	UserID    int64  `json:"user_id"`
-	Name      string `json:"name"`
-	Username  string `json:"username"`
-	FirstName string `json:"first_name"`
-	IsSpeaker bool   `json:"is_speaker"`
+	UserID              int64  `json:"user_id"`
+	Name                string `json:"name"`
+	Username            string `json:"username"`
+	FirstName           string `json:"first_name"`
+	PhotoURL            string `json:"photo_url"`
+	IsSpeaker           bool   `json:"is_speaker"`
+	IsModerator         bool   `json:"is_moderator"`
+	IsNew               bool   `json:"is_new"`
+	IsFollowedBySpeaker bool   `json:"is_followed_by_speaker"`
+	IsInvitedAsSpeaker  bool   `json:"is_invited_as_speaker"`
 }
 
 type pubnubMessage struct {
@@ -46,25 +52,43 @@ type pubnubMessage struct {
 	} `json:"m"`
 }
 
-var customLogger = log.New(os.Stderr, "", 0)
+// stdWriter writes to the standard logger's current output, so that log time
+// lines are redacted like all other output.
+type stdWriter struct{}
+
+func (stdWriter) Write(b []byte) (int, error) { return log.Writer().Write(b) }
+
+var customLogger = log.New(stdWriter{}, "", 0)
 
 func l(ts time.Time, format string, args ...interface{}) {
 	customLogger.SetPrefix(ts.Format("2006-01-02 15:04:05_"))
 	customLogger.Printf(format, args...)
 }
 
+// learnProfile makes log redaction mask the user's names.
+func learnProfile(p *pubnubUser) {
+	redact.Learn(redact.Name, p.Name)
+	redact.Learn(redact.Name, p.Username)
+	redact.Learn(redact.Name, p.FirstName)
+	redact.Learn(redact.Photo, p.PhotoURL)
+}
+
 var reHeartbeat = regexp.MustCompile(`channel/channel_user.([^.]+)\.(\d+)/heartbeat`)
 
 func (c *Clubhouse) updateIDs(m *logMessage) {
 	if m := reHeartbeat.FindStringSubmatch(m.Request.URL); len(m) > 0 {
 		var err error
+		if c.ChannelID != m[1] {
+			log.Printf("Active channel is now %s", m[1])
+		}
 		c.ChannelID = m[1]
+		c.addChannel(m[1])
 		c.UserID, err = strconv.ParseInt(m[2], 10, 64)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if c.RequestHeaders["CH-UserID"] != "" && c.RequestHeaders["CH-UserID"] != m[2] {
-			log.Printf("WARN: inconsistent user-id %s and %d", c.RequestHeaders["CH-UserID"], c.UserID)
+		if id := c.Session.Header("CH-UserID"); id != "" && id != m[2] {
+			log.Printf("WARN: inconsistent user-id %s and %d", id, c.UserID)
 		}
 	}
 }
@@ -75,7 +99,7 @@ func (c *Clubhouse) updateUsers(logm *logMessage) {
 	}
 	var msg pubnubMessage
 	if err := json.Unmarshal([]byte(logm.Response.Text), &msg); err != nil {
-		log.Printf("ERROR: unmarshaling pubnub message: %v\n%v", err, logm)
+		log.Printf("ERROR: unmarshaling pubnub message from %s: %v", logm.Request.URL, err)
 		return
 	}
 	// log.Printf("PubnubMessage string: %s", logm.Response.Text)
@@ -83,55 +107,114 @@ func (c *Clubhouse) updateUsers(logm *logMessage) {
 	sec, dec := math.Modf(logm.Ts)
 	ts := time.Unix(int64(sec), int64(dec*(1e9)))
 	for _, m := range msg.M {
-		if m.D.Channel != c.ChannelID {
-			l(ts, "WARN: inconsistent channel id; got %s want %s", m.D.Channel, c.ChannelID)
+		if m.D.Channel == "" {
+			m.D.Channel = c.ChannelID
+		}
+		if m.D.Channel == "" {
+			l(ts, "WARN: ignoring %q message without a channel", m.D.Action)
+			continue
 		}
+		ch := c.addChannel(m.D.Channel)
+		ch.LastTime = ts
 		if m.D.UserProfile != nil && c.UserID != 0 && m.D.UserProfile.UserID != c.UserID {
-			if u, ok := c.Users[m.D.UserProfile.UserID]; ok {
-				u.Profile = m.D.UserProfile
-			} else {
-				c.Users[m.D.UserProfile.UserID] = &User{Profile: m.D.UserProfile}
+			u, ok := ch.Users[m.D.UserProfile.UserID]
+			if !ok {
+				u = &User{JoinedAt: ts}
+				ch.Users[m.D.UserProfile.UserID] = u
+			}
+			speaker := m.D.UserProfile.IsSpeaker
+			u.Profile = m.D.UserProfile
+			learnProfile(u.Profile)
+			u.setSpeaker(ts, speaker)
+			if !ok {
+				c.emit(Event{Type: UserJoined, Time: ts, Channel: ch.ID, UserID: m.D.UserProfile.UserID})
 			}
-			l(ts, "User update: %+v", m.D.UserProfile)
+			l(ts, "[%s] User update: %+v", ch.ID, m.D.UserProfile)
 		}
 		if m.D.Action == "unraise_hands" {
-			if u, ok := c.Users[m.D.UserID]; ok {
-				l(ts, "User unraised the hand: %+v", u.Profile)
+			if u, ok := ch.Users[m.D.UserID]; ok {
+				l(ts, "[%s] User unraised the hand: %+v", ch.ID, u.Profile)
 				u.RaisedHand = false
+				ch.dequeue(m.D.UserID)
+				c.emit(Event{Type: HandLowered, Time: ts, Channel: ch.ID, UserID: m.D.UserID})
 			} else {
-				l(ts, "User %d unraised the hand, but profile not found", m.D.UserID)
+				l(ts, "[%s] User %d unraised the hand, but profile not found", ch.ID, m.D.UserID)
 			}
 		}
+		// Users are only known from a profile once the bot knows its own
+		// ID, so these may be missing, e.g. before the first heartbeat.
+		var id int64
+		if m.D.UserProfile != nil {
+			id = m.D.UserProfile.UserID
+		}
 		if m.D.Action == "raise_hands" {
-			if time.Now().Sub(ts) > time.Second {
-				l(ts, "User raised the hand: %+v (OLD)", c.Users[m.D.UserProfile.UserID].Profile)
+			if u, ok := ch.Users[id]; !ok {
+				l(ts, "[%s] User %d raised the hand, but profile not found", ch.ID, id)
+			} else if c.clock.Now().Sub(ts) > time.Second && c.resumeAfter.IsZero() {
+				// Hands raised while the bot was down are only trusted if
+				// there is a restored snapshot covering the time before them.
+				l(ts, "[%s] User raised the hand: %+v (OLD)", ch.ID, u.Profile)
 			} else {
-				l(ts, "User raised the hand: %+v", c.Users[m.D.UserProfile.UserID].Profile)
-				c.Users[m.D.UserProfile.UserID].RaisedHand = true
+				l(ts, "[%s] User raised the hand: %+v", ch.ID, u.Profile)
+				u.RaisedHand = true
+				u.HandRaisedAt = ts
+				ch.enqueue(id)
+				c.emit(Event{Type: HandRaised, Time: ts, Channel: ch.ID, UserID: id})
 			}
 		}
-		if m.D.Action == "add_speaker" && m.D.UserProfile.UserID != c.UserID {
-			l(ts, "Speaker added: %+v", c.Users[m.D.UserProfile.UserID].Profile)
-			c.Users[m.D.UserProfile.UserID].RaisedHand = false
+		if m.D.Action == "add_speaker" && id != c.UserID {
+			if u, ok := ch.Users[id]; ok {
+				l(ts, "[%s] Speaker added: %+v", ch.ID, u.Profile)
+				u.RaisedHand = false
+				ch.dequeue(id)
+				c.emit(Event{Type: SpeakerAdded, Time: ts, Channel: ch.ID, UserID: id})
+			} else {
+				l(ts, "[%s] Speaker added: %d, but profile not found", ch.ID, id)
+			}
 		}
 		if m.D.Action == "remove_speaker" {
-			if u, ok := c.Users[m.D.UserID]; ok {
-				l(ts, "Speaker removed: %+v", u.Profile)
-				u.Profile.IsSpeaker = false
+			if u, ok := ch.Users[m.D.UserID]; ok {
+				l(ts, "[%s] Speaker removed: %+v", ch.ID, u.Profile)
+				turn := u.setSpeaker(ts, false)
+				c.emit(Event{Type: SpeakerRemoved, Time: ts, Channel: ch.ID, UserID: m.D.UserID, Turn: turn})
 			} else {
-				l(ts, "Speaker removal for user %d, but profile not found", m.D.UserID)
+				l(ts, "[%s] Speaker removal for user %d, but profile not found", ch.ID, m.D.UserID)
+			}
+		}
+		if m.D.Action == "mute_speaker" || m.D.Action == "make_moderator" || m.D.Action == "remove_moderator" {
+			if u, ok := ch.Users[m.D.UserID]; ok {
+				l(ts, "[%s] %s: %+v", ch.ID, m.D.Action, u.Profile)
+				switch m.D.Action {
+				case "mute_speaker":
+					u.Muted = true
+				case "make_moderator":
+					u.Profile.IsModerator = true
+				case "remove_moderator":
+					u.Profile.IsModerator = false
+				}
+			} else {
+				l(ts, "[%s] %s for user %d, but profile not found", ch.ID, m.D.Action, m.D.UserID)
 			}
 		}
 		if m.D.Action == "leave_channel" && m.D.UserID == c.UserID {
-			l(ts, "Cleaning up channel information %s", c.ChannelID)
-			c.ChannelID = ""
-			c.Users = make(map[int64]*User)
+			l(ts, "Cleaning up channel information %s", ch.ID)
+			delete(c.Channels, ch.ID)
+			if c.ChannelID == ch.ID {
+				c.ChannelID = ""
+			}
+			c.emit(Event{Type: ChannelLeft, Time: ts, Channel: ch.ID, UserID: m.D.UserID})
 		} else if m.D.Action == "leave_channel" {
-			if u, ok := c.Users[m.D.UserID]; ok {
-				l(ts, "User left the channel: %+v", u.Profile)
-				delete(c.Users, m.D.UserID)
+			if u, ok := ch.Users[m.D.UserID]; ok {
+				l(ts, "[%s] User left the channel: %+v", ch.ID, u.Profile)
+				if u.Profile.IsSpeaker {
+					turn := u.setSpeaker(ts, false)
+					c.emit(Event{Type: SpeakerRemoved, Time: ts, Channel: ch.ID, UserID: m.D.UserID, Turn: turn})
+				}
+				c.emit(Event{Type: UserLeft, Time: ts, Channel: ch.ID, UserID: m.D.UserID})
+				delete(ch.Users, m.D.UserID)
+				ch.dequeue(m.D.UserID)
 			} else {
-				l(ts, "User left the channel: %d (no profile)", m.D.UserID)
+				l(ts, "[%s] User left the channel: %d (no profile)", ch.ID, m.D.UserID)
 			}
 		}
 	}
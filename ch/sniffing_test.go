@@ -0,0 +1,36 @@
+package ch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/ch/chtest"
+)
+
+func TestRaisedHandBeforeHeartbeat(t *testing.T) {
+	s := chtest.NewServer("chan", 1)
+	defer s.Close()
+	club, err := s.NewClubhouse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := club.Subscribe(ctx)
+
+	// Without a heartbeat the bot does not know its own ID, so the user is
+	// not added and their raised hand must be ignored.
+	s.Join(chtest.Profile{UserID: 2, Username: "early"})
+	s.RaiseHand(2)
+	s.Connect()
+	s.Join(chtest.Profile{UserID: 3, Username: "late"})
+	s.RaiseHand(3)
+	if !ch.Wait(ctx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && e.UserID == 3 }) {
+		t.Fatal("no HandRaised event for user 3")
+	}
+	if got := club.Candidates("chan"); len(got) != 1 || got[0] != 3 {
+		t.Errorf("Candidates() = %v, want [3]", got)
+	}
+}
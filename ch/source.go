@@ -0,0 +1,357 @@
+package ch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hpcloud/tail"
+	"github.com/knyar/housebot/proxy"
+)
+
+// maxLineSize bounds a single log line; pubnub subscribe responses can be large.
+const maxLineSize = 16 * 1024 * 1024
+
+// Source produces mitmdump-formatted JSON log lines. Lines is closed once the
+// source is exhausted, after which Err reports why.
+type Source interface {
+	Lines() <-chan string
+	Err() error
+}
+
+// DefaultSourceClients are the networks the tcp:// and http:// sources accept
+// lines from unless an allow parameter is given: only the local host, since
+// a line can carry credentials and fake room events.
+const DefaultSourceClients = "127.0.0.0/8,::1/128"
+
+// OpenSource creates a source from a command-line spec: "-" reads stdin,
+// "tcp://host:port" and "http://host:port/path" listen for lines sent over the
+// network, "proxy://host:port" runs an intercepting proxy (see NewProxySource),
+// and anything else is treated as a file to tail. Network sources take an
+// allow parameter with comma-separated networks to accept lines from, e.g.
+// tcp://:9091?allow=192.168.1.0/24; it defaults to DefaultSourceClients.
+func OpenSource(spec string) (Source, error) {
+	switch {
+	case spec == "-":
+		return NewReaderSource(os.Stdin), nil
+	case strings.HasPrefix(spec, "tcp://"), strings.HasPrefix(spec, "http://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse source url: %v", err)
+		}
+		allow := u.Query().Get("allow")
+		if allow == "" {
+			allow = DefaultSourceClients
+		}
+		clients, err := proxy.ParseNetworks(allow)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "tcp" {
+			return NewTCPSource(u.Host, clients)
+		}
+		s := NewHTTPSource(clients)
+		mux := http.NewServeMux()
+		mux.Handle(u.Path, s)
+		l, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Listening for log lines on http://%s%s from %s", u.Host, u.Path, allow)
+		go func() { s.fail(http.Serve(l, mux)) }()
+		return s, nil
+	case strings.HasPrefix(spec, "proxy://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse source url: %v", err)
+		}
+		q := u.Query()
+		return NewProxySource(u.Host, ProxySourceConfig{
+			Transparent: q.Get("mode") == "transparent",
+			CACert:      q.Get("ca"),
+			CAKey:       q.Get("ca_key"),
+			Log:         q.Get("log"),
+		})
+	}
+	return NewFileSource(spec)
+}
+
+type fileSource struct {
+	t     *tail.Tail
+	lines chan string
+}
+
+func NewFileSource(path string) (Source, error) {
+	t, err := tail.TailFile(path, tail.Config{ReOpen: true, MustExist: true, Follow: true})
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSource{t: t, lines: make(chan string)}
+	go func() {
+		for line := range t.Lines {
+			s.lines <- line.Text
+		}
+		close(s.lines)
+	}()
+	return s, nil
+}
+
+func (s *fileSource) Lines() <-chan string { return s.lines }
+func (s *fileSource) Err() error           { return s.t.Wait() }
+
+type readerSource struct {
+	lines chan string
+	err   error
+}
+
+// NewReaderSource reads lines from r until EOF.
+func NewReaderSource(r io.Reader) Source {
+	s := &readerSource{lines: make(chan string)}
+	go func() {
+		s.err = scanLines(r, s.lines)
+		close(s.lines)
+	}()
+	return s
+}
+
+func (s *readerSource) Lines() <-chan string { return s.lines }
+func (s *readerSource) Err() error           { return s.err }
+
+func scanLines(r io.Reader, lines chan<- string) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		lines <- scanner.Text()
+	}
+	return scanner.Err()
+}
+
+// netSource is shared by the network listeners: lines from any number of
+// connections are merged into one channel, which is closed when the listener
+// fails. Handlers still running at that point have their lines dropped.
+type netSource struct {
+	lines  chan string
+	done   chan struct{}
+	mu     sync.RWMutex
+	closed bool
+	err    error
+	once   sync.Once
+}
+
+func newNetSource() netSource {
+	return netSource{lines: make(chan string), done: make(chan struct{})}
+}
+
+func (s *netSource) Lines() <-chan string { return s.lines }
+func (s *netSource) Err() error           { return s.err }
+
+func (s *netSource) fail(err error) {
+	s.once.Do(func() {
+		// Unblock senders before waiting for them to let go of the lock.
+		close(s.done)
+		s.mu.Lock()
+		s.err = err
+		s.closed = true
+		close(s.lines)
+		s.mu.Unlock()
+	})
+}
+
+// send passes a line on unless the source has failed, returning false if it
+// has.
+func (s *netSource) send(line string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.lines <- line:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// scan sends the lines read from r until EOF or until the source fails.
+func (s *netSource) scan(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		if !s.send(scanner.Text()) {
+			return fmt.Errorf("log source closed")
+		}
+	}
+	return scanner.Err()
+}
+
+type tcpSource struct {
+	netSource
+	l       net.Listener
+	clients []*net.IPNet
+}
+
+// NewTCPSource listens on addr and reads newline-separated log lines from every
+// accepted connection coming from one of clients, or from anywhere if clients
+// is nil.
+func NewTCPSource(addr string, clients []*net.IPNet) (Source, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Listening for log lines on tcp://%s", l.Addr())
+	s := &tcpSource{netSource: newNetSource(), l: l, clients: clients}
+	go s.accept()
+	return s, nil
+}
+
+func (s *tcpSource) accept() {
+	var wg sync.WaitGroup
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			wg.Wait()
+			s.fail(err)
+			return
+		}
+		if !proxy.Allowed(s.clients, conn.RemoteAddr().String()) {
+			log.Printf("WARN: refusing log source connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			log.Printf("Log source connected from %s", conn.RemoteAddr())
+			if err := s.scan(conn); err != nil {
+				log.Printf("ERROR reading log lines from %s: %v", conn.RemoteAddr(), err)
+			}
+			log.Printf("Log source %s disconnected", conn.RemoteAddr())
+		}()
+	}
+}
+
+// HTTPSource is an http.Handler that accepts POSTed log lines.
+type HTTPSource struct {
+	netSource
+	clients []*net.IPNet
+}
+
+// NewHTTPSource creates a handler accepting lines from clients, or from
+// anywhere if clients is nil.
+func NewHTTPSource(clients []*net.IPNet) *HTTPSource {
+	return &HTTPSource{netSource: newNetSource(), clients: clients}
+}
+
+func (s *HTTPSource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !proxy.Allowed(s.clients, req.RemoteAddr) {
+		log.Printf("WARN: refusing log lines from %s", req.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer req.Body.Close()
+	if err := s.scan(req.Body); err != nil {
+		http.Error(w, fmt.Sprintf("could not read lines: %v", err), http.StatusBadRequest)
+	}
+}
+
+type ProxySourceConfig struct {
+	// Transparent makes the proxy accept connections redirected by iptables
+	// rather than act as an explicit HTTP proxy.
+	Transparent bool
+	// CACert and CAKey are the PEM files of the CA that signs intercepted
+	// hosts' certificates. They default to data/ca.pem and data/ca-key.pem
+	// and are created if missing.
+	CACert, CAKey string
+	// Log, if set, is a file the lines are also appended to.
+	Log string
+}
+
+type proxySource struct {
+	netSource
+}
+
+// NewProxySource runs an intercepting proxy on addr and produces a line for
+// every request the phone makes to Clubhouse, replacing mitmdump.
+func NewProxySource(addr string, cfg ProxySourceConfig) (Source, error) {
+	if cfg.CACert == "" {
+		cfg.CACert = "data/ca.pem"
+	}
+	if cfg.CAKey == "" {
+		cfg.CAKey = "data/ca-key.pem"
+	}
+	ca, err := proxy.LoadOrCreateCA(cfg.CACert, cfg.CAKey)
+	if err != nil {
+		return nil, err
+	}
+	s := &proxySource{newNetSource()}
+	sink := proxy.Sink(func(line []byte) { s.send(string(line)) })
+	if cfg.Log != "" {
+		file, err := proxy.FileSink(cfg.Log)
+		if err != nil {
+			return nil, err
+		}
+		sink = proxy.MultiSink(file, sink)
+	}
+	p := proxy.New(ca, sink)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Transparent {
+		log.Printf("Running transparent proxy on %s", addr)
+		go func() { s.fail(p.ServeTransparent(l)) }()
+	} else {
+		log.Printf("Running proxy on %s", addr)
+		go func() { s.fail(http.Serve(l, p)) }()
+	}
+	return s, nil
+}
+
+// MemorySource is fed by calling Push; it is mostly useful in tests.
+type MemorySource struct {
+	lines  chan string
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{lines: make(chan string, 1024)}
+}
+
+// Push queues lines, blocking while the buffer is full. Lines pushed after
+// Close are dropped.
+func (s *MemorySource) Push(lines ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, l := range lines {
+		s.lines <- l
+	}
+}
+
+func (s *MemorySource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.lines)
+	}
+}
+
+func (s *MemorySource) Lines() <-chan string { return s.lines }
+func (s *MemorySource) Err() error           { return nil }
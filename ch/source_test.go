@@ -0,0 +1,121 @@
+package ch_test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+)
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func nextLine(t *testing.T, s ch.Source) (string, bool) {
+	t.Helper()
+	select {
+	case l, ok := <-s.Lines():
+		return l, ok
+	case <-time.After(2 * time.Second):
+		return "", false
+	}
+}
+
+func TestReaderSource(t *testing.T) {
+	s := ch.NewReaderSource(strings.NewReader("one\ntwo\n"))
+	var got []string
+	for l := range s.Lines() {
+		got = append(got, l)
+	}
+	if strings.Join(got, ",") != "one,two" || s.Err() != nil {
+		t.Errorf("got lines %q and error %v, want [one two] and nil", got, s.Err())
+	}
+}
+
+func TestMemorySourcePushAfterClose(t *testing.T) {
+	s := ch.NewMemorySource()
+	s.Push("one")
+	s.Close()
+	s.Close()
+	s.Push("two")
+	if l, ok := <-s.Lines(); !ok || l != "one" {
+		t.Errorf("first line = %q, %v; want one", l, ok)
+	}
+	if l, ok := <-s.Lines(); ok {
+		t.Errorf("got line %q after Close", l)
+	}
+}
+
+func TestTCPSource(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"?allow=127.0.0.1/32", true},
+		{"?allow=10.0.0.0/8", false},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			addr := freeAddr(t)
+			s, err := ch.OpenSource("tcp://" + addr + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprintln(conn, "line")
+			if l, ok := nextLine(t, s); ok != tc.want || (ok && l != "line") {
+				t.Errorf("got line %q, %v; want accepted = %v", l, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	local, err := ch.OpenSource("http://" + freeAddr(t) + "/lines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := local.(*ch.HTTPSource)
+	for _, tc := range []struct {
+		method, remote string
+		want           int
+	}{
+		{http.MethodPost, "192.168.1.2:1234", http.StatusForbidden},
+		{http.MethodGet, "127.0.0.1:1234", http.StatusMethodNotAllowed},
+		{http.MethodPost, "127.0.0.1:1234", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/lines", strings.NewReader("line\n"))
+		req.RemoteAddr = tc.remote
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			h.ServeHTTP(w, req)
+			close(done)
+		}()
+		if tc.want == http.StatusOK {
+			if l, ok := nextLine(t, h); !ok || l != "line" {
+				t.Errorf("%s from %s: got line %q, %v", tc.method, tc.remote, l, ok)
+			}
+		}
+		<-done
+		if w.Code != tc.want {
+			t.Errorf("%s from %s: status %d, want %d", tc.method, tc.remote, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// streamRefresh is how often the dashboard stream is refreshed even without
+// changes, so that remaining stage time stays current.
+const streamRefresh = time.Second
+
+// watch returns a channel that receives a value whenever room or bot state
+// may have changed. Notifications are coalesced.
+func (c *Clubhouse) watch(ctx context.Context) <-chan struct{} {
+	w := make(chan struct{}, 1)
+	c.mu.Lock()
+	c.watchers[w] = true
+	c.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		delete(c.watchers, w)
+		c.mu.Unlock()
+	}()
+	return w
+}
+
+// changed must be called with c.mu held.
+func (c *Clubhouse) changed() {
+	for w := range c.watchers {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type apiDashboard struct {
+	State   *apiState `json:"state"`
+	Channel string    `json:"channel"`
+	Roster  []apiUser `json:"roster"`
+	Queue   []apiUser `json:"queue"`
+}
+
+func (c *Clubhouse) dashboard(channel string) *apiDashboard {
+	d := &apiDashboard{State: c.state(), Channel: channel}
+	if channel == "" {
+		d.Channel = d.State.ActiveChannel
+	}
+	d.Roster, _ = c.roster(channel)
+	d.Queue, _ = c.queue(channel)
+	return d
+}
+
+// apiStream pushes dashboard state for the channel given in the query as
+// Server-Sent Events whenever it changes.
+func (c *Clubhouse) apiStream(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	channel := req.URL.Query().Get("channel")
+	changes := c.watch(req.Context())
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	t := time.NewTicker(streamRefresh)
+	defer t.Stop()
+	for {
+		data, err := json.Marshal(c.dashboard(channel))
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-req.Context().Done():
+			return
+		case <-changes:
+		case <-t.C:
+		}
+	}
+}
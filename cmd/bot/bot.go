@@ -7,14 +7,18 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/knyar/housebot/auth"
 	"github.com/knyar/housebot/capture"
 	"github.com/knyar/housebot/ch"
 	"github.com/knyar/housebot/gpt3"
+	"github.com/knyar/housebot/history"
+	"github.com/knyar/housebot/redact"
 	"github.com/knyar/housebot/voice"
 )
 
@@ -27,27 +31,134 @@ var thanks = []string{
 
 func main() {
 	stageTime := flag.Duration("stage_time", 60*time.Second, "how long each speaker gets on stage")
+	silenceTimeout := flag.Duration("silence_timeout", 10*time.Second, "end a turn early when the speaker has not been heard for this long; 0 to disable")
+	stageGrace := flag.Duration("stage_grace", 10*time.Second, "extend a turn by this when the speaker is talking at its end; 0 to disable")
+	maxStageTime := flag.Duration("max_stage_time", 0, "maximum length of a turn including extensions; defaults to -stage_time plus -stage_grace, capped at the 60s speech recognition limit")
+	cueSpec := flag.String("cues", voice.DefaultCues, "semicolon-separated cues played this long before the end of a turn, with text to say or none for a chime, e.g. 30s;10s:Ten seconds left.")
 	responseTime := flag.Duration("response_time", 40*time.Second, "response length")
-	mitmLog := flag.String("mitm_log", "/var/log/mitmproxy.log", "path to mitmdump-generated log of Clubhouse traffic")
+	mitmLog := flag.String("mitm_log", "/var/log/mitmproxy.log", "mitmdump-generated log of Clubhouse traffic: a file path, '-' for stdin, tcp://host:port or http://host:port/path to receive lines over the network (from the local host only unless ?allow=<networks> is given), or proxy://host:port?mode=transparent to run the intercepting proxy in-process")
 	soundIn := flag.String("sound_in", "alsasrc", "gstreamer input")
 	soundOut := flag.String("sound_out", "autoaudiosink", "gstreamer output")
 	responseFrequncy := flag.Int("response_frequency", 3, "respond after every X humans")
+	credentials := flag.String("credentials", "data/credentials.json", "JSON file with Clubhouse API headers; harvested headers are saved back to it")
+	apiRate := flag.Float64("api_rate", 2, "maximum average number of Clubhouse API calls per second")
+	apiBurst := flag.Int("api_burst", 5, "maximum burst of Clubhouse API calls")
+	stateFile := flag.String("state_file", "data/state.json", "file to save room state to and restore it from on startup; empty to disable")
+	stateMaxAge := flag.Duration("state_max_age", 10*time.Minute, "ignore saved state and raised hands older than this")
+	rotated := flag.Bool("rotated", false, "read the rotated segments of the -mitm_log file, plain or gzipped, before following it")
+	since := flag.String("since", "", "skip -mitm_log lines before this time, e.g. 2021-03-09 18:00 or 6h for six hours ago; implies -rotated")
+	pubnubDirect := flag.Bool("pubnub", false, "join -channel through the API and subscribe to its events from PubNub directly instead of reading -mitm_log")
+	policyName := flag.String("policy", "random", "how to pick the next speaker among raised hands: random, fifo, least_spoken, weighted or newcomer")
+	rulesFile := flag.String("rules", "data/rules.json", "JSON file with cooldowns, turn limits, bans and protected users; created when rules are changed through the API")
+	panelSize := flag.Int("panel", 1, "number of speakers to keep on stage together; above 1, instead of clearing the stage, one seat is rotated every -stage_time divided by this; turns are then neither ended by silence nor extended and no cues are played, so -silence_timeout, -stage_grace, -max_stage_time and -cues cannot be used with it")
+	channel := flag.String("channel", "", "ID of the channel to run in; defaults to the channel the account is currently in")
+	historyFile := flag.String("history", "data/history.jsonl", "file to append room event history to; empty to disable")
+	staleLog := flag.Duration("stale_log", 2*time.Minute, "report the bot as not ready when no mitmdump log lines arrive for this long; 0 to disable")
+	listen := flag.String("listen", "127.0.0.1:9090", "address to serve the control page and API on; other than loopback it requires credentials")
+	authToken := flag.String("auth_token", os.Getenv("HOUSEBOT_AUTH_TOKEN"), "static token granting moderator access to the control endpoint, as a bearer token or basic auth password")
+	authBasic := flag.String("auth_basic", "", "user:password granting moderator access to the control endpoint")
+	authUsers := flag.String("auth_users", "", "JSON file with control endpoint users and their roles (viewer or moderator)")
+	tlsCert := flag.String("tls_cert", "", "TLS certificate file for the control endpoint")
+	tlsKey := flag.String("tls_key", "", "TLS key file for the control endpoint")
+	redactFields := flag.String("redact", redact.DefaultFields, "data to mask in log output: comma-separated token, device_id, name and photo, or all or none")
 	flag.Parse()
 
+	fields, err := redact.Parse(*redactFields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	redact.Install(redact.New(fields...))
+	policy, err := ch.ParsePolicy(*policyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cues, err := voice.ParseCues(*cueSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *panelSize < 1 {
+		log.Fatalf("-panel must be at least 1")
+	}
+	if *panelSize > 1 {
+		// The panel is captured as a whole, so speech cannot be attributed
+		// to a seat to time its turn.
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "silence_timeout", "stage_grace", "max_stage_time", "cues":
+				log.Fatalf("-%s cannot be used with -panel", f.Name)
+			}
+		})
+	}
+
 	ctx := context.Background()
 
-	ch, err := ch.New(*mitmLog)
+	var src ch.Source
+	var pubnub *ch.PubNubSource
+	start, err := ch.ParseSince(*since, time.Now())
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.HandleFunc("/ch", ch.HttpRoot)
-	log.Println("Listening 9090")
-	go func() { log.Fatal(http.ListenAndServe(":9090", nil)) }()
+	if *pubnubDirect {
+		if *channel == "" {
+			log.Fatal("-pubnub requires -channel, as there is no log to learn the active channel from")
+		}
+		pubnub = ch.NewPubNubSource()
+		src = pubnub
+	} else if *rotated || !start.IsZero() {
+		if src, err = ch.NewRotatedSource(*mitmLog, start); err != nil {
+			log.Fatal(err)
+		}
+	} else if src, err = ch.OpenSource(*mitmLog); err != nil {
+		log.Fatal(err)
+	}
+	opts := []ch.Option{ch.WithCredentials(*credentials), ch.WithRateLimit(*apiRate, *apiBurst), ch.WithStaleLog(*staleLog), ch.WithStageTime(*stageTime / time.Duration(*panelSize)), ch.WithRules(*rulesFile)}
+	if *stateFile != "" {
+		opts = append(opts, ch.WithStateFile(*stateFile, 5*time.Second, *stateMaxAge))
+	}
+	var hist *history.Store
+	if *historyFile != "" {
+		if hist, err = history.Open(*historyFile); err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, ch.WithObserver(hist.Observe))
+	}
+	club, err := ch.New(src, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pubnub != nil {
+		cfg, err := club.API.PubNubConfig(ctx, *channel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pubnub.Start(ctx, cfg)
+	}
+	events := club.Subscribe(ctx)
+	http.HandleFunc("/ch", club.HttpRoot)
+	club.RegisterAPI(http.DefaultServeMux, "/ch/api/v1")
+	authn, err := auth.New(auth.Config{Token: *authToken, Basic: *authBasic, UsersFile: *authUsers})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := authn.CheckAddr(*listen); err != nil {
+		log.Fatal(err)
+	}
+	// Health endpoints are left unauthenticated for process supervisors.
+	mux := http.NewServeMux()
+	club.RegisterHealth(mux)
+	mux.Handle("/", authn.Wrap(http.DefaultServeMux))
+	go func() { log.Fatal(auth.ListenAndServe(*listen, *tlsCert, *tlsKey, mux)) }()
 
 	// Catch up with the log.
 	time.Sleep(1 * time.Second)
 
-	if err := ch.UninviteAll(ctx, 5*time.Second); err != nil {
+	if err := club.API.ValidateSession(ctx); err != nil {
+		log.Printf("ERROR: %v", err)
+	} else {
+		log.Printf("Clubhouse session is valid")
+	}
+
+	if err := club.UninviteAll(ctx, *channel, 5*time.Second); err != nil {
 		log.Printf("ERROR while uninviting all: %v", err)
 	}
 
@@ -55,6 +166,28 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	club.AddHealthCheck("capture", true, capturer.Health)
+	if *panelSize > 1 {
+		b := &bot{
+			club:              club,
+			channel:           *channel,
+			policy:            policy,
+			policyName:        *policyName,
+			events:            events,
+			hist:              hist,
+			capturer:          capturer,
+			stageTime:         *stageTime,
+			responseTime:      *responseTime,
+			responseFrequency: *responseFrequncy,
+			soundOut:          *soundOut,
+		}
+		b.panel(ctx, *panelSize)
+		return
+	}
+	// Turns end the capture themselves, also on silence unless
+	// -silence_timeout is 0.
+	capturer.IdleTimeout = 0
+	go voice.PrepareCues(ctx, cues)
 
 	responses := []string{
 		// "Just a reminder. The rules of this room are simple. Each speaker gets the stage for one minute; next speaker is chosen randomly amongst people who raised their hand. Thanks for joining us.",
@@ -64,43 +197,49 @@ func main() {
 	var humanText []string
 	for {
 		if len(responses) > 0 {
+			club.SetBotStatus(ch.BotStatus{State: "responding", Channel: *channel})
 			for _, resp := range responses {
 				ctx2, cancel := context.WithCancel(ctx)
-				ch.SetVoiceCancelFunc(cancel)
+				club.SetVoiceCancelFunc(cancel)
+				hist.Note(club, history.Response, *channel, 0, resp)
 				err = voice.Say(ctx2, *soundOut, resp)
 				if err != nil {
 					log.Printf("ERROR: %v", err)
 				}
 				cancel()
-				ch.SetVoiceCancelFunc(nil)
+				club.SetVoiceCancelFunc(nil)
 			}
 			responses = nil
 		}
 
-		users := ch.Candidates()
-		if len(users) == 0 {
-			time.Sleep(100 * time.Millisecond)
+		u, ok := club.Next(*channel, policy)
+		if !ok {
+			club.SetBotStatus(ch.BotStatus{State: "waiting for raised hands", Channel: *channel})
+			waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+			ch.Wait(waitCtx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && (*channel == "" || e.Channel == *channel) })
+			cancel()
 			continue
 		}
-		idx := rand.Int63n(int64(len(users)))
-		u := users[idx]
-		if err := ch.Invite(ctx, u, 5*time.Second); err != nil {
+		log.Printf("Picked user %d with the %s policy", u, *policyName)
+		club.SetBotStatus(ch.BotStatus{State: "inviting", Channel: *channel, Speaker: u})
+		if err := club.Invite(ctx, *channel, u, 5*time.Second); err != nil {
 			log.Printf("ERROR while inviting user %d: %v", u, err)
-			err = ch.SpeakerRequest("uninvite_speaker", u)
+			err = club.API.UninviteSpeaker(ctx, *channel, u)
 			log.Printf("Tried to uninvite user %d: %v", u, err)
 			continue
 		}
+		hist.Note(club, history.Invited, *channel, u, "")
 
 		humansSpoken = humansSpoken + 1
 
 		// Pre-fetch a 'thanks' response.
 		var resp string
-		if user := ch.User(u); user != nil {
+		if user := club.User(*channel, u); user != nil {
 			resp = fmt.Sprintf(thanks[rand.Intn(len(thanks))], user.Profile.FirstName)
 			go func() { voice.Tts(ctx, resp) }()
 		}
 
-		log.Printf("Capturing audio for %v", stageTime)
+		log.Printf("Capturing audio for up to %v", *stageTime)
 		captured := make(chan string, 1)
 		done := make(chan struct{})
 		go func() {
@@ -111,17 +250,45 @@ func main() {
 			captured <- c
 		}()
 
-		deadline := time.Now().Add(*stageTime)
-		for deadline.Sub(time.Now()) > 0 {
-			if user := ch.User(u); user == nil || !user.Profile.IsSpeaker {
+		turn := &capture.Turn{Start: time.Now(), Stage: *stageTime, Silence: *silenceTimeout, Grace: *stageGrace, Max: *maxStageTime}
+		club.SetBotStatus(ch.BotStatus{State: "listening", Channel: *channel, Speaker: u, Deadline: turn.Deadline()})
+		countdown := &voice.Countdown{Device: *soundOut, Cues: cues, Pause: capturer.Pause}
+		if *silenceTimeout > 0 || *stageGrace > 0 {
+			// Voice is only measured across the room, so anyone left on
+			// stage counts as the speaker talking.
+			for _, s := range club.Speakers(*channel) {
+				if s != u && club.Protected(*channel, s) {
+					log.Printf("WARN: protected speaker %d is on stage with user %d; their voice keeps the turn from ending on silence and extends it", s, u)
+				}
+			}
+		}
+		cueCtx, cancelCues := context.WithCancel(ctx)
+		for {
+			if user := club.User(*channel, u); user == nil || !user.Profile.IsSpeaker {
 				log.Printf("Speaker %d left early; cancelling recording", u)
 				break
 			}
-			time.Sleep(200 * time.Millisecond)
+			decision, next := turn.Decide(time.Now(), capturer.LastVoice())
+			if decision.Ended() {
+				log.Printf("Ending turn of user %d after %v: %v", u, time.Since(turn.Start).Round(time.Second), decision)
+				break
+			}
+			if decision == capture.Extend {
+				log.Printf("User %d is still talking; extending their turn until %s", u, turn.Deadline().Format("15:04:05"))
+				club.SetBotStatus(ch.BotStatus{State: "listening (extended)", Channel: *channel, Speaker: u, Deadline: turn.Deadline()})
+			}
+			if cue := countdown.Update(cueCtx, time.Now(), turn.Deadline()); !cue.IsZero() && cue.Before(next) {
+				next = cue
+			}
+			stageCtx, cancel := context.WithDeadline(ctx, next)
+			ch.Wait(stageCtx, events, func(e ch.Event) bool { return e.UserID == u || e.Type == ch.ChannelLeft })
+			cancel()
 		}
+		cancelCues()
 		close(done)
+		club.SetBotStatus(ch.BotStatus{State: "thanking speaker", Channel: *channel, Speaker: u})
 
-		if err := ch.UninviteAll(ctx, 5*time.Second); err != nil {
+		if err := club.UninviteAll(ctx, *channel, 5*time.Second); err != nil {
 			log.Printf("ERROR while uninviting all: %v", err)
 		}
 
@@ -139,10 +306,12 @@ func main() {
 		}
 
 		c := <-captured
+		hist.NoteTranscript(club, *channel, []int64{u}, c)
 		c = fmt.Sprintf("%s.", strings.TrimSuffix(c, "."))
 		humanText = append(humanText, c)
 
-		if len(humanText) >= *responseFrequncy || len(ch.Candidates()) == 0 {
+		if len(humanText) >= *responseFrequncy || len(club.Eligible(*channel)) == 0 {
+			club.SetBotStatus(ch.BotStatus{State: "composing response", Channel: *channel})
 			resp, err := gpt3.Respond(ctx, humanText, *responseTime)
 			if err != nil {
 				log.Fatal(err)
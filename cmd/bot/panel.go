@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knyar/housebot/capture"
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/gpt3"
+	"github.com/knyar/housebot/history"
+	"github.com/knyar/housebot/voice"
+)
+
+// bot holds what the panel loop needs from the command line.
+type bot struct {
+	club              *ch.Clubhouse
+	channel           string
+	policy            ch.Policy
+	policyName        string
+	events            <-chan ch.Event
+	hist              *history.Store
+	capturer          *capture.Capturer
+	stageTime         time.Duration
+	responseTime      time.Duration
+	responseFrequency int
+	soundOut          string
+}
+
+// seat is a place on the panel held by a speaker the bot invited.
+type seat struct {
+	user     int64
+	deadline time.Time
+	thanks   string
+}
+
+// window is a capture of the stage while the panel did not change, so that
+// what was heard can be attributed to the panelists.
+type window struct {
+	panel []int64
+	start time.Time
+	done  chan struct{}
+	text  chan string
+}
+
+const (
+	// panelIdleTimeout ends a window after a while of silence, so that what
+	// was said reaches the history while the panel goes on.
+	panelIdleTimeout = 5 * time.Second
+	// windowLimit is how long a window captures before it is replaced by a
+	// new one, leaving a margin for the loop to notice before the
+	// recognition request hits its limit.
+	windowLimit = capture.StreamLimit - 2*time.Second
+)
+
+type transcript struct {
+	panel []int64
+	text  string
+}
+
+// panel keeps up to size speakers on stage together. Rather than clearing the
+// stage, the seat held longest is handed to the next speaker every stage time
+// divided by size, so that each panelist stays for about the stage time.
+// Panelists keep their seats past their time while nobody else waits.
+func (b *bot) panel(ctx context.Context, size int) {
+	rotation := b.stageTime / time.Duration(size)
+	b.capturer.IdleTimeout = panelIdleTimeout
+	transcripts := make(chan transcript, size+1)
+	var seats []seat
+	var w *window
+	var humanText []string
+	// Thanks are said while the panel goes on, but responses wait for them
+	// so that the two are not played over each other.
+	var thanking sync.WaitGroup
+
+	closeWindow := func() {
+		if w == nil {
+			return
+		}
+		close(w.done)
+		go func(w *window) { transcripts <- transcript{panel: w.panel, text: <-w.text} }(w)
+		w = nil
+	}
+	thank := func(s seat) {
+		if s.thanks == "" {
+			return
+		}
+		thanking.Add(1)
+		go func() {
+			defer thanking.Done()
+			// The next window is already capturing.
+			resume := b.capturer.Pause()
+			defer resume()
+			if err := voice.Say(ctx, b.soundOut, s.thanks); err != nil {
+				log.Printf("ERROR: %v", err)
+			}
+		}()
+	}
+
+	for {
+	collect:
+		for {
+			select {
+			case t := <-transcripts:
+				if t.text = strings.TrimSpace(t.text); t.text != "" {
+					b.hist.NoteTranscript(b.club, b.channel, t.panel, t.text)
+					humanText = append(humanText, fmt.Sprintf("%s.", strings.TrimSuffix(t.text, ".")))
+				}
+			default:
+				break collect
+			}
+		}
+		if w != nil {
+			// Capture ends by itself after a while of silence.
+			select {
+			case text := <-w.text:
+				close(w.done)
+				go func(t transcript) { transcripts <- t }(transcript{panel: w.panel, text: text})
+				w = nil
+			default:
+			}
+		}
+		if w != nil && time.Since(w.start) >= windowLimit {
+			closeWindow()
+		}
+
+		changed := false
+		kept := seats[:0]
+		for _, s := range seats {
+			if u := b.club.User(b.channel, s.user); u == nil || !u.Profile.IsSpeaker {
+				log.Printf("Panelist %d left the stage", s.user)
+				changed = true
+				continue
+			}
+			kept = append(kept, s)
+		}
+		seats = kept
+
+		if len(seats) > 0 && !time.Now().Before(seats[0].deadline) && len(b.club.Eligible(b.channel)) > 0 {
+			s := seats[0]
+			seats = seats[1:]
+			closeWindow()
+			changed = true
+			if b.club.Protected(b.channel, s.user) {
+				// Protected users keep their place on stage but give up
+				// their seat.
+				log.Printf("Panelist %d is protected; leaving them on stage", s.user)
+			} else {
+				log.Printf("Rotating panelist %d off the stage", s.user)
+				b.club.SetBotStatus(ch.BotStatus{State: "thanking speaker", Channel: b.channel, Speaker: s.user, Panel: panelists(seats)})
+				uninviteCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				if err := b.club.Uninvite(uninviteCtx, b.channel, s.user); err != nil {
+					log.Printf("ERROR while uninviting user %d: %v", s.user, err)
+				}
+				cancel()
+				thank(s)
+			}
+
+			if len(humanText) >= b.responseFrequency {
+				thanking.Wait()
+				b.respond(ctx, humanText, panelists(seats))
+				humanText = nil
+			}
+		}
+
+		for len(seats) < size {
+			u, ok := b.club.Next(b.channel, b.policy)
+			if !ok {
+				break
+			}
+			log.Printf("Picked user %d with the %s policy for the panel", u, b.policyName)
+			b.club.SetBotStatus(ch.BotStatus{State: "inviting", Channel: b.channel, Speaker: u, Panel: panelists(seats)})
+			if err := b.club.Invite(ctx, b.channel, u, 5*time.Second); err != nil {
+				log.Printf("ERROR while inviting user %d: %v", u, err)
+				err = b.club.API.UninviteSpeaker(ctx, b.channel, u)
+				log.Printf("Tried to uninvite user %d: %v", u, err)
+				break
+			}
+			b.hist.Note(b.club, history.Invited, b.channel, u, "")
+			// Seats are staggered so that they come up for rotation one at
+			// a time.
+			deadline := time.Now().Add(b.stageTime)
+			if len(seats) > 0 {
+				if d := seats[len(seats)-1].deadline.Add(rotation); d.After(deadline) {
+					deadline = d
+				}
+			}
+			s := seat{user: u, deadline: deadline}
+			if user := b.club.User(b.channel, u); user != nil {
+				s.thanks = fmt.Sprintf(thanks[rand.Intn(len(thanks))], user.Profile.FirstName)
+				go func() { voice.Tts(ctx, s.thanks) }()
+			}
+			seats = append(seats, s)
+			changed = true
+		}
+
+		if len(seats) == 0 {
+			closeWindow()
+			if len(humanText) > 0 {
+				thanking.Wait()
+				b.respond(ctx, humanText, nil)
+				humanText = nil
+			}
+			b.club.SetBotStatus(ch.BotStatus{State: "waiting for raised hands", Channel: b.channel})
+			waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+			ch.Wait(waitCtx, b.events, func(e ch.Event) bool { return e.Type == ch.HandRaised && (b.channel == "" || e.Channel == b.channel) })
+			cancel()
+			continue
+		}
+		if changed {
+			closeWindow()
+		}
+		if w == nil {
+			w = b.listen(ctx, panelists(seats))
+		}
+
+		b.club.SetBotStatus(ch.BotStatus{State: "listening", Channel: b.channel, Panel: panelists(seats), Deadline: seats[0].deadline})
+		wait := time.Second
+		if d := time.Until(seats[0].deadline); d > 0 && d < wait {
+			wait = d
+		}
+		if d := time.Until(w.start.Add(windowLimit)); d > 0 && d < wait {
+			wait = d
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		ch.Wait(waitCtx, b.events, func(e ch.Event) bool {
+			for _, s := range seats {
+				if e.UserID == s.user {
+					return true
+				}
+			}
+			return e.Type == ch.ChannelLeft
+		})
+		cancel()
+	}
+}
+
+// listen starts capturing audio attributed to a panel.
+func (b *bot) listen(ctx context.Context, panel []int64) *window {
+	log.Printf("Capturing audio for panel %v", panel)
+	w := &window{panel: panel, start: time.Now(), done: make(chan struct{}), text: make(chan string, 1)}
+	go func() {
+		c, err := b.capturer.Capture(ctx, w.done)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.text <- c
+	}()
+	return w
+}
+
+// respond composes a response to what was heard and says it.
+func (b *bot) respond(ctx context.Context, humanText []string, panel []int64) {
+	b.club.SetBotStatus(ch.BotStatus{State: "composing response", Channel: b.channel, Panel: panel})
+	resp, err := gpt3.Respond(ctx, humanText, b.responseTime)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Strip last sentence that is likely to be incomplete.
+	resp = stripSentence.ReplaceAllString(resp, "$1")
+
+	b.club.SetBotStatus(ch.BotStatus{State: "responding", Channel: b.channel, Panel: panel})
+	ctx2, cancel := context.WithCancel(ctx)
+	b.club.SetVoiceCancelFunc(cancel)
+	b.hist.Note(b.club, history.Response, b.channel, 0, resp)
+	if err := voice.Say(ctx2, b.soundOut, resp); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+	cancel()
+	b.club.SetVoiceCancelFunc(nil)
+}
+
+func panelists(seats []seat) []int64 {
+	users := make([]int64, len(seats))
+	for i, s := range seats {
+		users[i] = s.user
+	}
+	return users
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/knyar/housebot/history"
+	"github.com/knyar/housebot/redact"
+)
+
+// parseTime accepts RFC 3339 timestamps as well as dates and date-times in
+// local time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not parse time %q", s)
+}
+
+func main() {
+	file := flag.String("history", "data/history.jsonl", "event history file written by the bot")
+	report := flag.String("report", "speakers", "what to report: events, turns or speakers")
+	format := flag.String("format", "text", "output format: text, csv or json")
+	channel := flag.String("channel", "", "only include this channel")
+	user := flag.String("user", "", "only include this user ID or username")
+	since := flag.String("since", "", "only include records at or after this time, e.g. 2021-03-09 or 2021-03-09 18:00")
+	until := flag.String("until", "", "only include records before this time")
+	types := flag.String("types", "", "comma-separated record types to include in the events report")
+	redactFields := flag.String("redact", "none", "data to mask in the output: name, all or none")
+	flag.Parse()
+
+	q := history.Query{Channel: *channel, User: *user}
+	var err error
+	if q.Since, err = parseTime(*since); err != nil {
+		log.Fatal(err)
+	}
+	if q.Until, err = parseTime(*until); err != nil {
+		log.Fatal(err)
+	}
+	if *report != "events" {
+		q.Types = []string{history.TurnStarted, history.TurnEnded}
+	} else if *types != "" {
+		q.Types = strings.Split(*types, ",")
+	}
+	records, err := history.ReadFile(*file, q)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fields, err := redact.Parse(*redactFields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	records = history.Redact(records, redact.New(fields...))
+
+	switch *report + "/" + *format {
+	case "events/json":
+		err = history.WriteJSON(os.Stdout, records)
+	case "events/csv":
+		err = history.WriteRecordsCSV(os.Stdout, records)
+	case "events/text":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, r := range records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format("2006-01-02 15:04:05"), r.Channel, r.Type, userName(r.UserID, r.Username, r.Name), r.Text)
+		}
+		err = w.Flush()
+	case "turns/json":
+		err = history.WriteJSON(os.Stdout, history.Turns(records))
+	case "turns/csv":
+		err = history.WriteTurnsCSV(os.Stdout, history.Turns(records))
+	case "turns/text":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, t := range history.Turns(records) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", t.Start.Local().Format("2006-01-02 15:04:05"), t.Channel, userName(t.UserID, t.Username, t.Name), seconds(t.Seconds))
+		}
+		err = w.Flush()
+	case "speakers/json":
+		err = history.WriteJSON(os.Stdout, history.Speakers(history.Turns(records)))
+	case "speakers/csv":
+		err = history.WriteSpeakersCSV(os.Stdout, history.Speakers(history.Turns(records)))
+	case "speakers/text":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "CHANNEL\tUSER\tTURNS\tTIME\tFIRST\n")
+		for _, s := range history.Speakers(history.Turns(records)) {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%v\t%s\n", s.Channel, userName(s.UserID, s.Username, s.Name), s.Turns, seconds(s.Seconds), s.First.Local().Format("2006-01-02 15:04:05"))
+		}
+		err = w.Flush()
+	default:
+		log.Fatalf("unknown report %q or format %q", *report, *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func userName(id int64, username, name string) string {
+	switch {
+	case id == 0:
+		return "-"
+	case username != "":
+		return fmt.Sprintf("%s (@%s, %d)", name, username, id)
+	case name != "":
+		return fmt.Sprintf("%s (%d)", name, id)
+	}
+	return fmt.Sprint(id)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Second)
+}
@@ -2,58 +2,161 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
-	"math/rand"
 	"net/http"
+	"os"
 	"regexp"
 	"time"
 
+	"github.com/knyar/housebot/auth"
 	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/history"
+	"github.com/knyar/housebot/redact"
+	"github.com/knyar/housebot/voice"
 )
 
+// stageTime is how long each speaker gets on stage.
+const stageTime = 60 * time.Second
+
 var stripSentence = regexp.MustCompile(`(.*\.).*`)
 
 func main() {
+	mitmLog := flag.String("mitm_log", "/var/log/mitmproxy.log", "mitmdump-generated log of Clubhouse traffic: a file path, '-' for stdin, tcp://host:port or http://host:port/path to receive lines over the network (from the local host only unless ?allow=<networks> is given), or proxy://host:port?mode=transparent to run the intercepting proxy in-process")
+	rotated := flag.Bool("rotated", false, "read the rotated segments of the -mitm_log file, plain or gzipped, before following it")
+	since := flag.String("since", "", "skip -mitm_log lines before this time, e.g. 2021-03-09 18:00 or 6h for six hours ago; implies -rotated")
+	pubnubDirect := flag.Bool("pubnub", false, "join -channel through the API and subscribe to its events from PubNub directly instead of reading -mitm_log")
+	policyName := flag.String("policy", "random", "how to pick the next speaker among raised hands: random, fifo, least_spoken, weighted or newcomer")
+	rulesFile := flag.String("rules", "data/rules.json", "JSON file with cooldowns, turn limits, bans and protected users; created when rules are changed through the API")
+	soundOut := flag.String("sound_out", "autoaudiosink", "gstreamer output for cues")
+	cueSpec := flag.String("cues", voice.DefaultCues, "semicolon-separated cues played this long before the end of a turn, with text to say or none for a chime, e.g. 30s;10s:Ten seconds left.")
+	channel := flag.String("channel", "", "ID of the channel to run in; defaults to the channel the account is currently in")
+	historyFile := flag.String("history", "data/history.jsonl", "file to append room event history to; empty to disable")
+	staleLog := flag.Duration("stale_log", 2*time.Minute, "report the bot as not ready when no mitmdump log lines arrive for this long; 0 to disable")
+	listen := flag.String("listen", "127.0.0.1:9090", "address to serve the control page and API on; other than loopback it requires credentials")
+	authToken := flag.String("auth_token", os.Getenv("HOUSEBOT_AUTH_TOKEN"), "static token granting moderator access to the control endpoint, as a bearer token or basic auth password")
+	authBasic := flag.String("auth_basic", "", "user:password granting moderator access to the control endpoint")
+	authUsers := flag.String("auth_users", "", "JSON file with control endpoint users and their roles (viewer or moderator)")
+	tlsCert := flag.String("tls_cert", "", "TLS certificate file for the control endpoint")
+	tlsKey := flag.String("tls_key", "", "TLS key file for the control endpoint")
+	redactFields := flag.String("redact", redact.DefaultFields, "data to mask in log output: comma-separated token, device_id, name and photo, or all or none")
+	flag.Parse()
+
+	fields, err := redact.Parse(*redactFields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	redact.Install(redact.New(fields...))
+	policy, err := ch.ParsePolicy(*policyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cues, err := voice.ParseCues(*cueSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ctx := context.Background()
 
-	ch, err := ch.New("/var/log/mitmproxy.log")
+	var src ch.Source
+	var pubnub *ch.PubNubSource
+	start, err := ch.ParseSince(*since, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *pubnubDirect {
+		if *channel == "" {
+			log.Fatal("-pubnub requires -channel, as there is no log to learn the active channel from")
+		}
+		pubnub = ch.NewPubNubSource()
+		src = pubnub
+	} else if *rotated || !start.IsZero() {
+		if src, err = ch.NewRotatedSource(*mitmLog, start); err != nil {
+			log.Fatal(err)
+		}
+	} else if src, err = ch.OpenSource(*mitmLog); err != nil {
+		log.Fatal(err)
+	}
+	opts := []ch.Option{ch.WithStaleLog(*staleLog), ch.WithStageTime(stageTime), ch.WithRules(*rulesFile)}
+	var hist *history.Store
+	if *historyFile != "" {
+		if hist, err = history.Open(*historyFile); err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, ch.WithObserver(hist.Observe))
+	}
+	club, err := ch.New(src, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.HandleFunc("/ch", ch.HttpRoot)
-	log.Println("Listening 9090")
-	go func() { log.Fatal(http.ListenAndServe(":9090", nil)) }()
+	if pubnub != nil {
+		cfg, err := club.API.PubNubConfig(ctx, *channel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pubnub.Start(ctx, cfg)
+	}
+	events := club.Subscribe(ctx)
+	http.HandleFunc("/ch", club.HttpRoot)
+	club.RegisterAPI(http.DefaultServeMux, "/ch/api/v1")
+	authn, err := auth.New(auth.Config{Token: *authToken, Basic: *authBasic, UsersFile: *authUsers})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := authn.CheckAddr(*listen); err != nil {
+		log.Fatal(err)
+	}
+	// Health endpoints are left unauthenticated for process supervisors.
+	mux := http.NewServeMux()
+	club.RegisterHealth(mux)
+	mux.Handle("/", authn.Wrap(http.DefaultServeMux))
+	go func() { log.Fatal(auth.ListenAndServe(*listen, *tlsCert, *tlsKey, mux)) }()
+
+	go voice.PrepareCues(ctx, cues)
 
 	// Catch up with the log.
 	time.Sleep(1 * time.Second)
 
 	for {
-		if err := ch.UninviteAll(ctx, 5*time.Second); err != nil {
+		if err := club.UninviteAll(ctx, *channel, 5*time.Second); err != nil {
 			log.Printf("ERROR while uninviting all: %v", err)
 		}
 
-		users := ch.Candidates()
-		if len(users) == 0 {
-			time.Sleep(100 * time.Millisecond)
+		u, ok := club.Next(*channel, policy)
+		if !ok {
+			club.SetBotStatus(ch.BotStatus{State: "waiting for raised hands", Channel: *channel})
+			waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+			ch.Wait(waitCtx, events, func(e ch.Event) bool { return e.Type == ch.HandRaised && (*channel == "" || e.Channel == *channel) })
+			cancel()
 			continue
 		}
-		idx := rand.Int63n(int64(len(users)))
-		u := users[idx]
-		if err := ch.Invite(ctx, u, 5*time.Second); err != nil {
+		log.Printf("Picked user %d with the %s policy", u, *policyName)
+		club.SetBotStatus(ch.BotStatus{State: "inviting", Channel: *channel, Speaker: u})
+		if err := club.Invite(ctx, *channel, u, 5*time.Second); err != nil {
 			log.Printf("ERROR while inviting user %d: %v", u, err)
-			err = ch.SpeakerRequest("uninvite_speaker", u)
+			err = club.API.UninviteSpeaker(ctx, *channel, u)
 			log.Printf("Tried to uninvite user %d: %v", u, err)
 			continue
 		}
+		hist.Note(club, history.Invited, *channel, u, "")
 
-		wait := 60 * time.Second
-		log.Printf("Sleeping for %v", wait)
-		deadline := time.Now().Add(wait)
-		for deadline.Sub(time.Now()) > 0 {
-			if user := ch.User(u); user == nil || !user.Profile.IsSpeaker {
+		log.Printf("Sleeping for %v", stageTime)
+		deadline := time.Now().Add(stageTime)
+		club.SetBotStatus(ch.BotStatus{State: "listening", Channel: *channel, Speaker: u, Deadline: deadline})
+		countdown := &voice.Countdown{Device: *soundOut, Cues: cues}
+		cueCtx, cancelCues := context.WithCancel(ctx)
+		for time.Now().Before(deadline) {
+			if user := club.User(*channel, u); user == nil || !user.Profile.IsSpeaker {
 				break
 			}
-			time.Sleep(200 * time.Millisecond)
+			next := deadline
+			if cue := countdown.Update(cueCtx, time.Now(), deadline); !cue.IsZero() && cue.Before(next) {
+				next = cue
+			}
+			stageCtx, cancel := context.WithDeadline(ctx, next)
+			ch.Wait(stageCtx, events, func(e ch.Event) bool { return e.UserID == u || e.Type == ch.ChannelLeft })
+			cancel()
 		}
+		cancelCues()
 	}
 }
@@ -0,0 +1,70 @@
+// Command proxy intercepts the Clubhouse app's traffic and logs it in the
+// format of mitmdump.py, for bots started with -mitm_log pointing at the log
+// file or at a tcp:// source that -forward sends lines to.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/knyar/housebot/proxy"
+	"github.com/knyar/housebot/redact"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to listen on; see -allow for who may connect")
+	allow := flag.String("allow", proxy.DefaultClients, "comma-separated networks allowed to use the proxy")
+	mode := flag.String("mode", "transparent", "'transparent' to accept connections redirected by iptables, or 'explicit' to act as an HTTP proxy configured on the phone")
+	caCert := flag.String("ca_cert", "data/ca.pem", "CA certificate to install on the phone; generated if missing")
+	caKey := flag.String("ca_key", "data/ca-key.pem", "CA private key")
+	hosts := flag.String("hosts", strings.Join(proxy.DefaultHosts, ","), "comma-separated hosts to intercept; other traffic is passed through")
+	logFile := flag.String("log", "/var/log/mitmproxy.log", "file to append log lines to; empty to disable")
+	forward := flag.String("forward", "", "host:port of a bot's tcp:// log source to also send lines to")
+	redactFields := flag.String("redact", redact.DefaultFields, "data to mask in log output: comma-separated token, device_id, name and photo, or all or none")
+	flag.Parse()
+
+	fields, err := redact.Parse(*redactFields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	redact.Install(redact.New(fields...))
+
+	ca, err := proxy.LoadOrCreateCA(*caCert, *caKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var sinks []proxy.Sink
+	if *logFile != "" {
+		s, err := proxy.FileSink(*logFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, s)
+	}
+	if *forward != "" {
+		sinks = append(sinks, proxy.TCPSink(*forward))
+	}
+	p := proxy.New(ca, proxy.MultiSink(sinks...))
+	p.Hosts = strings.Split(*hosts, ",")
+	if p.Clients, err = proxy.ParseNetworks(*allow); err != nil {
+		log.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch *mode {
+	case "transparent":
+		log.Printf("Running transparent proxy on %s", *listen)
+		log.Fatal(p.ServeTransparent(l))
+	case "explicit":
+		log.Printf("Running proxy on %s", *listen)
+		log.Fatal(http.Serve(l, p))
+	default:
+		log.Fatalf("unknown -mode %q", *mode)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/knyar/housebot/auth"
+	"github.com/knyar/housebot/ch"
+	"github.com/knyar/housebot/history"
+	"github.com/knyar/housebot/redact"
+)
+
+func main() {
+	mitmLog := flag.String("mitm_log", "/var/log/mitmproxy.log", "recorded mitmdump log to replay; may be gzipped")
+	rotated := flag.Bool("rotated", false, "replay the rotated segments of -mitm_log, plain or gzipped, before the file itself")
+	since := flag.String("since", "", "start replaying at this time, e.g. 2021-03-09 18:00 or 6h for six hours ago")
+	speed := flag.Float64("speed", 1, "replay speed multiplier; 0 replays as fast as possible")
+	historyFile := flag.String("history", "", "file to append events of the replayed log to, backfilling event history")
+	listen := flag.String("listen", "", "address to serve the control page on during replay, e.g. 127.0.0.1:9090; other than loopback it requires credentials")
+	authToken := flag.String("auth_token", os.Getenv("HOUSEBOT_AUTH_TOKEN"), "static token granting moderator access to the control endpoint, as a bearer token or basic auth password")
+	authBasic := flag.String("auth_basic", "", "user:password granting moderator access to the control endpoint")
+	authUsers := flag.String("auth_users", "", "JSON file with control endpoint users and their roles (viewer or moderator)")
+	tlsCert := flag.String("tls_cert", "", "TLS certificate file for the control endpoint")
+	tlsKey := flag.String("tls_key", "", "TLS key file for the control endpoint")
+	redactFields := flag.String("redact", redact.DefaultFields, "data to mask in log output: comma-separated token, device_id, name and photo, or all or none")
+	flag.Parse()
+
+	fields, err := redact.Parse(*redactFields)
+	if err != nil {
+		log.Fatal(err)
+	}
+	redact.Install(redact.New(fields...))
+
+	ctx := context.Background()
+
+	start, err := ch.ParseSince(*since, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stat(*mitmLog); err != nil {
+		log.Fatal(err)
+	}
+	segments := []string{*mitmLog}
+	if *rotated {
+		if segments, err = ch.Segments(*mitmLog); err != nil {
+			log.Fatal(err)
+		}
+		segments = append(segments, *mitmLog)
+	}
+	f := ch.OpenSegments(segments)
+	defer f.Close()
+	var r io.Reader = f
+	if !start.IsZero() {
+		r = ch.SkipBefore(r, start)
+	}
+
+	var opts []ch.Option
+	if *historyFile != "" {
+		hist, err := history.Open(*historyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer hist.Close()
+		// The observer sees every event, unlike a subscriber that may fall
+		// behind, and skips events already in the history.
+		opts = append(opts, ch.WithObserver(hist.Observe))
+	}
+	club, err := ch.New(ch.NewReplaySource(r, *speed), opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	events := club.Subscribe(ctx)
+	if *listen != "" {
+		// The API can make real moderation calls with credentials recorded
+		// in the log, so it is protected just like in the bot.
+		http.HandleFunc("/ch", club.HttpRoot)
+		club.RegisterAPI(http.DefaultServeMux, "/ch/api/v1")
+		authn, err := auth.New(auth.Config{Token: *authToken, Basic: *authBasic, UsersFile: *authUsers})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := authn.CheckAddr(*listen); err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/", authn.Wrap(http.DefaultServeMux))
+		go func() { log.Fatal(auth.ListenAndServe(*listen, *tlsCert, *tlsKey, mux)) }()
+	}
+
+	printEvent := func(e ch.Event) {
+		log.Printf("Event at %s: %v channel %s user %d", e.Time.Format("2006-01-02 15:04:05.000"), e.Type, e.Channel, e.UserID)
+	}
+loop:
+	for {
+		select {
+		case e := <-events:
+			printEvent(e)
+		case <-club.Done():
+			break loop
+		}
+	}
+	for len(events) > 0 {
+		printEvent(<-events)
+	}
+
+	log.Printf("Replay finished at %s", club.LastTime)
+	log.Printf("Active channel: %q", club.ChannelID)
+	for _, id := range club.ChannelIDs() {
+		log.Printf("Channel %s: candidates: %v, speakers: %v", id, club.Candidates(id), club.Speakers(id))
+	}
+	if *listen != "" {
+		log.Printf("Still serving the control page on %s", *listen)
+		select {}
+	}
+}
@@ -4,7 +4,6 @@ go 1.15
 
 require (
 	cloud.google.com/go v0.77.0
-	github.com/avast/retry-go v3.0.0+incompatible
 	github.com/aws/aws-sdk-go v1.37.25
 	github.com/hpcloud/tail v1.0.0
 	github.com/sashabaranov/go-gpt3 v0.0.0-20201216121239-64c0048394ea
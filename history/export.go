@@ -0,0 +1,84 @@
+package history
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/knyar/housebot/redact"
+)
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatSeconds(s float64) string {
+	return fmt.Sprintf("%.1f", s)
+}
+
+func writeCSV(w io.Writer, header []string, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	cw.WriteAll(rows)
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("could not write CSV: %v", err)
+	}
+	return nil
+}
+
+func WriteRecordsCSV(w io.Writer, records []Record) error {
+	var rows [][]string
+	for _, r := range records {
+		rows = append(rows, []string{formatTime(r.Time), r.Channel, r.Type, fmt.Sprint(r.UserID), r.Username, r.Name, formatSeconds(r.Seconds), r.Text})
+	}
+	return writeCSV(w, []string{"time", "channel", "type", "user_id", "username", "name", "seconds", "text"}, rows)
+}
+
+func WriteTurnsCSV(w io.Writer, turns []Turn) error {
+	var rows [][]string
+	for _, t := range turns {
+		rows = append(rows, []string{t.Channel, fmt.Sprint(t.UserID), t.Username, t.Name, formatTime(t.Start), formatTime(t.End), formatSeconds(t.Seconds)})
+	}
+	return writeCSV(w, []string{"channel", "user_id", "username", "name", "start", "end", "seconds"}, rows)
+}
+
+func WriteSpeakersCSV(w io.Writer, speakers []Speaker) error {
+	var rows [][]string
+	for _, s := range speakers {
+		rows = append(rows, []string{s.Channel, fmt.Sprint(s.UserID), s.Username, s.Name, fmt.Sprint(s.Turns), formatSeconds(s.Seconds), formatTime(s.First), formatTime(s.Last)})
+	}
+	return writeCSV(w, []string{"channel", "user_id", "username", "name", "turns", "seconds", "first", "last"}, rows)
+}
+
+// WriteJSON writes v, e.g. a slice of records, turns or speakers, as an
+// indented JSON array.
+func WriteJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("could not write JSON: %v", err)
+	}
+	return nil
+}
+
+// Redact masks the names in records, and the names of their users wherever
+// they appear in the bot's responses.
+func Redact(records []Record, r *redact.Redactor) []Record {
+	for _, rec := range records {
+		r.Learn(redact.Name, rec.Username)
+		r.Learn(redact.Name, rec.Name)
+	}
+	redacted := make([]Record, len(records))
+	for i, rec := range records {
+		rec.Username = r.Value(redact.Name, rec.Username)
+		rec.Name = r.Value(redact.Name, rec.Name)
+		rec.Text = r.String(rec.Text)
+		redacted[i] = rec
+	}
+	return redacted
+}
@@ -0,0 +1,354 @@
+// Package history keeps an append-only record of room events in a JSON-lines
+// file and answers questions like who spoke in a room and for how long.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knyar/housebot/ch"
+)
+
+// Record types.
+const (
+	Joined      = "joined"
+	Left        = "left"
+	HandRaised  = "hand_raised"
+	HandLowered = "hand_lowered"
+	TurnStarted = "turn_started"
+	TurnEnded   = "turn_ended"
+	ChannelLeft = "channel_left"
+	// Invited, Response and Transcript are recorded by the bot rather than
+	// observed.
+	Invited    = "invited"
+	Response   = "response"
+	Transcript = "transcript"
+)
+
+var eventTypes = map[ch.EventType]string{
+	ch.UserJoined:     Joined,
+	ch.UserLeft:       Left,
+	ch.HandRaised:     HandRaised,
+	ch.HandLowered:    HandLowered,
+	ch.SpeakerAdded:   TurnStarted,
+	ch.SpeakerRemoved: TurnEnded,
+	ch.ChannelLeft:    ChannelLeft,
+}
+
+type Record struct {
+	Time     time.Time `json:"time"`
+	Channel  string    `json:"channel"`
+	Type     string    `json:"type"`
+	UserID   int64     `json:"user_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	// Seconds is the length of the turn, for TurnEnded.
+	Seconds float64 `json:"seconds,omitempty"`
+	// Text is what the bot said, for Response, or what was heard, for
+	// Transcript.
+	Text string `json:"text,omitempty"`
+	// Panel lists the speakers on stage during a Transcript that cannot be
+	// attributed to a single user.
+	Panel []int64 `json:"panel,omitempty"`
+}
+
+// FromEvent converts a room event into a record.
+func FromEvent(e ch.Event) Record {
+	return Record{
+		Time:     e.Time,
+		Channel:  e.Channel,
+		Type:     eventTypes[e.Type],
+		UserID:   e.UserID,
+		Username: e.Username,
+		Name:     e.Name,
+		Seconds:  e.Turn.Seconds(),
+	}
+}
+
+// Store appends records to a JSON-lines file. Observed events are only
+// recorded if they are newer than the newest record in the file when it was
+// opened, since the bot re-reads the log on restart.
+type Store struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	newest time.Time
+}
+
+func Open(path string) (*Store, error) {
+	newest, err := newestRecord(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open history: %v", err)
+	}
+	return &Store{path: path, f: f, newest: newest}, nil
+}
+
+// newestRecord returns the time of the newest record in the history file at
+// path, or a zero time if there is none.
+func newestRecord(path string) (time.Time, error) {
+	var newest time.Time
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return newest, nil
+	}
+	if err != nil {
+		return newest, fmt.Errorf("could not open history: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var rec struct {
+			Time time.Time `json:"time"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return newest, fmt.Errorf("could not parse history line %d: %v", n, err)
+		}
+		if rec.Time.After(newest) {
+			newest = rec.Time
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return newest, fmt.Errorf("could not read history: %v", err)
+	}
+	return newest, nil
+}
+
+func (s *Store) Path() string { return s.path }
+
+func (s *Store) Append(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("could not append to history: %v", err)
+	}
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// Observe appends the record of a room event unless the history already
+// covers its time. It is meant to be passed to ch.WithObserver.
+func (s *Store) Observe(e ch.Event) {
+	if !e.Time.After(s.newest) {
+		return
+	}
+	if err := s.Append(FromEvent(e)); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// Note records something the bot did in channel, defaulting to the active
+// channel of club. It does nothing on a nil Store.
+func (s *Store) Note(club *ch.Clubhouse, typ, channel string, user int64, text string) {
+	if s == nil {
+		return
+	}
+	if channel == "" {
+		channel = club.ActiveChannel()
+	}
+	r := Record{Time: time.Now(), Channel: channel, Type: typ, UserID: user, Text: text}
+	if u := club.User(channel, user); u != nil {
+		r.Username, r.Name = u.Profile.Username, u.Profile.Name
+	}
+	if err := s.Append(r); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// NoteTranscript records what was heard while speakers were on stage,
+// attributing it to the user if there was only one.
+func (s *Store) NoteTranscript(club *ch.Clubhouse, channel string, speakers []int64, text string) {
+	if s == nil {
+		return
+	}
+	if len(speakers) == 1 {
+		s.Note(club, Transcript, channel, speakers[0], text)
+		return
+	}
+	if channel == "" {
+		channel = club.ActiveChannel()
+	}
+	r := Record{Time: time.Now(), Channel: channel, Type: Transcript, Text: text, Panel: speakers}
+	if err := s.Append(r); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// Query selects records. Zero fields match everything.
+type Query struct {
+	Channel string
+	// User matches either the user ID or the username.
+	User  string
+	Since time.Time
+	Until time.Time
+	Types []string
+}
+
+func (q Query) match(r Record) bool {
+	if q.Channel != "" && r.Channel != q.Channel {
+		return false
+	}
+	if q.User != "" && q.User != fmt.Sprint(r.UserID) && !strings.EqualFold(q.User, r.Username) {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if r.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Read returns the records in r matching q, in the order they were written.
+func Read(r io.Reader, q Query) ([]Record, error) {
+	records := []Record{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("could not parse history line %d: %v", n, err)
+		}
+		if q.match(rec) {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read history: %v", err)
+	}
+	return records, nil
+}
+
+// ReadFile returns the records in the history file at path matching q.
+func ReadFile(path string, q Query) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open history: %v", err)
+	}
+	defer f.Close()
+	return Read(f, q)
+}
+
+// Turn is a single stint on stage.
+type Turn struct {
+	Channel  string    `json:"channel"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Seconds  float64   `json:"seconds"`
+}
+
+// Turns pairs turn records into turns. A turn whose end is missing, e.g.
+// because the bot was stopped, ends at the last record of its channel.
+func Turns(records []Record) []Turn {
+	type key struct {
+		channel string
+		user    int64
+	}
+	open := make(map[key]*Turn)
+	last := make(map[string]time.Time)
+	turns := []Turn{}
+	for _, r := range records {
+		last[r.Channel] = r.Time
+		k := key{r.Channel, r.UserID}
+		switch r.Type {
+		case TurnStarted:
+			if _, ok := open[k]; !ok {
+				open[k] = &Turn{Channel: r.Channel, UserID: r.UserID, Username: r.Username, Name: r.Name, Start: r.Time}
+			}
+		case TurnEnded:
+			t, ok := open[k]
+			if !ok {
+				// The start was not recorded; rely on the observed length.
+				t = &Turn{Channel: r.Channel, UserID: r.UserID, Username: r.Username, Name: r.Name,
+					Start: r.Time.Add(-time.Duration(r.Seconds * float64(time.Second)))}
+			}
+			t.End = r.Time
+			t.Seconds = t.End.Sub(t.Start).Seconds()
+			turns = append(turns, *t)
+			delete(open, k)
+		}
+	}
+	for _, t := range open {
+		t.End = last[t.Channel]
+		t.Seconds = t.End.Sub(t.Start).Seconds()
+		turns = append(turns, *t)
+	}
+	sort.SliceStable(turns, func(i, j int) bool { return turns[i].Start.Before(turns[j].Start) })
+	return turns
+}
+
+// Speaker is the total time a user spent on stage in a channel.
+type Speaker struct {
+	Channel  string    `json:"channel"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Turns    int       `json:"turns"`
+	Seconds  float64   `json:"seconds"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+}
+
+// Speakers summarizes turns per channel and user, longest speakers first.
+func Speakers(turns []Turn) []Speaker {
+	type key struct {
+		channel string
+		user    int64
+	}
+	byKey := make(map[key]*Speaker)
+	var speakers []*Speaker
+	for _, t := range turns {
+		k := key{t.Channel, t.UserID}
+		s, ok := byKey[k]
+		if !ok {
+			s = &Speaker{Channel: t.Channel, UserID: t.UserID, First: t.Start}
+			byKey[k] = s
+			speakers = append(speakers, s)
+		}
+		if t.Username != "" || t.Name != "" {
+			s.Username, s.Name = t.Username, t.Name
+		}
+		s.Turns++
+		s.Seconds += t.Seconds
+		s.Last = t.End
+	}
+	result := make([]Speaker, len(speakers))
+	for i, s := range speakers {
+		result[i] = *s
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Seconds > result[j].Seconds })
+	return result
+}
@@ -0,0 +1,82 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knyar/housebot/ch"
+)
+
+func logLine(ts float64, url, response string) string {
+	line, err := json.Marshal(map[string]interface{}{
+		"ts": ts,
+		"request": map[string]interface{}{
+			"method":  "GET",
+			"headers": map[string]string{"Host": "clubhouse.pubnubapi.com"},
+			"url":     url,
+		},
+		"response": map[string]interface{}{"status_code": 200, "text": response},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(line)
+}
+
+func join(ts float64, user int64) string {
+	return logLine(ts, "https://clubhouse.pubnubapi.com/v2/subscribe/sub-c/channel_all.chan/0",
+		fmt.Sprintf(`{"m": [{"d": {"action": "join_channel", "channel": "chan", "user_profile": {"user_id": %d}}}]}`, user))
+}
+
+// run records the events of a bot reading lines into the history at path.
+func run(t *testing.T, path string, lines ...string) {
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	src := ch.NewMemorySource()
+	src.Push(lines...)
+	src.Close()
+	club, err := ch.New(src, ch.WithObserver(store.Observe), ch.WithTemplate("../ch/index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-club.Done()
+}
+
+func TestRestartDoesNotDuplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "housebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.jsonl")
+
+	lines := []string{
+		logLine(1000, "https://clubhouse.pubnubapi.com/v2/presence/sub-key/sub-c/channel/channel_user.chan.1/heartbeat", "{}"),
+		join(1001, 2),
+		join(1002, 3),
+	}
+	run(t, path, lines...)
+	records, err := ReadFile(path, Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records after the first run, want 2: %+v", len(records), records)
+	}
+
+	// On restart the log is read again from the start, with one new line.
+	run(t, path, append(lines, join(1003, 4))...)
+	if records, err = ReadFile(path, Query{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[2].UserID != 4 {
+		t.Errorf("got records %+v after the restart, want only user 4 added", records)
+	}
+}
@@ -7,12 +7,38 @@
 #    -A PREROUTING -i eth1 -p tcp -m tcp --dport 443 -j REDIRECT --to-ports 8080
 # 2. Run mitmdump in a transparent mode with this script:
 #    mitmdump --mode transparent --listen-port 8080 --listen-host 0.0.0.0 --showhost -s mitmdump.py
+#
+# To run the bot on a different machine, start it with
+# -mitm_log=tcp://:9091?allow=<mitmdump host>/32 and set
+# HOUSEBOT_FORWARD=bothost:9091 in mitmdump's environment; log lines will then
+# be sent to the bot in addition to being written to the file.
+#
+# cmd/proxy is a Go replacement for mitmdump and this script, and the bot can
+# also run it in-process with -mitm_log=proxy://:8080?mode=transparent.
 
 import datetime
 import json
+import os
+import socket
 import mitmproxy.http
 
 class Logger:
+    def __init__(self):
+        self.forward = os.environ.get('HOUSEBOT_FORWARD')
+        self.sock = None
+
+    def send(self, line):
+        if not self.forward:
+            return
+        try:
+            if self.sock is None:
+                host, port = self.forward.rsplit(':', 1)
+                self.sock = socket.create_connection((host, int(port)), timeout=5)
+            self.sock.sendall(line.encode())
+        except OSError as e:
+            print('could not forward log line to %s: %s' % (self.forward, e))
+            self.sock = None
+
     def response(self, flow: mitmproxy.http.HTTPFlow):
         if not flow.request.headers.get('host', '') in ['clubhouse.pubnub.com', 'clubhouse.pubnubapi.com', 'www.clubhouseapi.com']:
             return
@@ -31,7 +57,9 @@ class Logger:
                 'text': flow.response.text,
             },
         }
+        line = json.dumps(log) + '\n'
         with open('/var/log/mitmproxy.log', 'a+') as f:
-            f.write(json.dumps(log) + '\n')
+            f.write(line)
+        self.send(line)
 
 addons = [Logger()]
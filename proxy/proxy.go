@@ -0,0 +1,493 @@
+// Package proxy is an intercepting HTTPS proxy for the phone running the
+// Clubhouse app. It terminates TLS for Clubhouse and PubNub hosts with
+// certificates issued by its own CA and reports each request and response as a
+// JSON line in the format written by mitmdump.py, so it can feed package ch
+// directly. Traffic to other hosts is passed through untouched, though in
+// explicit mode only as CONNECT tunnels, and only clients on local networks
+// are served by default so that it is not an open proxy.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultHosts are the hosts whose traffic is intercepted and recorded.
+var DefaultHosts = []string{"clubhouse.pubnub.com", "clubhouse.pubnubapi.com", "www.clubhouseapi.com"}
+
+// Sink receives one JSON line, without the trailing newline, per intercepted
+// request.
+type Sink func(line []byte)
+
+// DefaultClients are the networks allowed to use the proxy by default: the
+// loopback, private and link-local ones the phone is expected on.
+const DefaultClients = "127.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,169.254.0.0/16,::1/128,fc00::/7,fe80::/10"
+
+// ParseNetworks parses a comma-separated list of CIDR networks.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse network: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+type Proxy struct {
+	CA    *CA
+	Hosts []string
+	Sink  Sink
+	// Clients are the networks connections are accepted from; nil allows
+	// any.
+	Clients []*net.IPNet
+	// Transport makes upstream requests. It must not add or strip
+	// Accept-Encoding, so that responses reach the app as sent.
+	Transport http.RoundTripper
+	// Dial connects to upstream hosts for passed-through connections.
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// errLocal is returned for upstream connections to the proxy's own host,
+// which would expose services listening only locally, such as the bot's log
+// source, or make the proxy connect to itself.
+var errLocal = errors.New("refusing to connect to a local address")
+
+// refuseLocal is a net.Dialer Control function failing connections to
+// loopback, unspecified or this host's own addresses. It sees the address
+// after name resolution, so host names resolving to them are refused too.
+func refuseLocal(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return errLocal
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return errLocal
+		}
+	}
+	return nil
+}
+
+// New creates a proxy serving DefaultClients and intercepting DefaultHosts.
+// Its Transport and Dial refuse to connect to the proxy's own host.
+func New(ca *CA, sink Sink) *Proxy {
+	clients, err := ParseNetworks(DefaultClients)
+	if err != nil {
+		panic(err)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: refuseLocal}
+	return &Proxy{
+		CA:      ca,
+		Hosts:   DefaultHosts,
+		Sink:    sink,
+		Clients: clients,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			DisableCompression:  true,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Dial: dialer.Dial,
+	}
+}
+
+// Allowed tells whether a client at addr, a host:port or IP address, is on
+// one of clients. Any client is allowed if clients is nil.
+func Allowed(clients []*net.IPNet, addr string) bool {
+	if clients == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	for _, n := range clients {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed tells whether a client at addr may use the proxy.
+func (p *Proxy) allowed(addr string) bool {
+	return Allowed(p.Clients, addr)
+}
+
+func (p *Proxy) intercepted(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range p.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP makes the proxy usable as an explicit HTTP proxy, handling both
+// CONNECT tunnels and plain HTTP requests. Plain requests are only forwarded to
+// intercepted hosts; other hosts are only reachable through tunnels to port
+// 443.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !p.allowed(req.RemoteAddr) {
+		log.Printf("WARN: refusing proxy request from %s", req.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodConnect {
+		if req.URL.Host == "" {
+			http.Error(w, "this is a proxy", http.StatusBadRequest)
+			return
+		}
+		if !p.intercepted(req.URL.Host) {
+			http.Error(w, "plain HTTP is only proxied to Clubhouse hosts", http.StatusForbidden)
+			return
+		}
+		req.RequestURI = ""
+		removeHopHeaders(req.Header)
+		resp, err := p.roundTrip(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		removeHopHeaders(resp.Header)
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil || port != "443" {
+		http.Error(w, "only port 443 can be tunnelled", http.StatusForbidden)
+		return
+	}
+	var upstream net.Conn
+	if !p.intercepted(host) {
+		if upstream, err = p.Dial("tcp", req.Host); err != nil {
+			log.Printf("WARN: could not connect to %s: %v", req.Host, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		log.Printf("ERROR: could not hijack CONNECT from %s: %v", req.RemoteAddr, err)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	if upstream != nil {
+		pipe(conn, upstream)
+		return
+	}
+	p.serveTLS(conn, host)
+}
+
+// ServeTransparent accepts connections redirected to l, e.g. by an iptables
+// REDIRECT rule for ports 80 and 443. TLS connections are routed by SNI.
+func (p *Proxy) ServeTransparent(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.serveTransparent(conn)
+	}
+}
+
+func (p *Proxy) serveTransparent(conn net.Conn) {
+	if !p.allowed(conn.RemoteAddr().String()) {
+		log.Printf("WARN: refusing proxy connection from %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	pc := &prefixConn{Conn: conn, r: br}
+	if first[0] != 0x16 { // Not a TLS handshake record.
+		p.serveConn(pc, "http", "")
+		return
+	}
+	sni, hello, err := peekSNI(pc)
+	if err != nil || sni == "" {
+		log.Printf("WARN: dropping TLS connection from %s without SNI: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	pc = &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), br)}
+	if !p.intercepted(sni) {
+		p.tunnel(pc, net.JoinHostPort(sni, "443"))
+		return
+	}
+	p.serveTLS(pc, sni)
+}
+
+// tunnel copies data between conn and addr until either side closes.
+func (p *Proxy) tunnel(conn net.Conn, addr string) {
+	upstream, err := p.Dial("tcp", addr)
+	if err != nil {
+		log.Printf("WARN: could not connect to %s: %v", addr, err)
+		conn.Close()
+		return
+	}
+	pipe(conn, upstream)
+}
+
+// pipe copies data between two connections until either side closes, and
+// closes both.
+func pipe(conn, upstream net.Conn) {
+	defer conn.Close()
+	defer upstream.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *Proxy) serveTLS(conn net.Conn, host string) {
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return p.CA.leaf(hello.ServerName)
+			}
+			return p.CA.leaf(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("WARN: TLS handshake for %s with %s failed; is the proxy CA trusted? %v", host, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	p.serveConn(tlsConn, "https", host)
+}
+
+// serveConn proxies HTTP/1.1 requests read from conn until it is closed.
+func (p *Proxy) serveConn(conn net.Conn, scheme, host string) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("WARN: could not read request from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if req.Host == "" {
+			req.Host = host
+		}
+		req.URL.Scheme = scheme
+		req.URL.Host = req.Host
+		req.RequestURI = ""
+		removeHopHeaders(req.Header)
+		resp, err := p.roundTrip(req)
+		if err != nil {
+			log.Printf("WARN: %s %s failed: %v", req.Method, req.URL, err)
+			resp = &http.Response{
+				StatusCode: http.StatusBadGateway,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"Content-Type": {"text/plain"}},
+				Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
+				Close:      true,
+			}
+		}
+		removeHopHeaders(resp.Header)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || resp.Close || req.Close {
+			return
+		}
+	}
+}
+
+// roundTrip forwards req upstream, recording the exchange if the host is
+// intercepted.
+func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
+	if !p.intercepted(req.URL.Host) || p.Sink == nil {
+		return p.Transport.RoundTrip(req)
+	}
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, fmt.Errorf("could not read request body: %v", err)
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	resp, err := p.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not read response body: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	p.record(req, reqBody, resp, respBody)
+	return resp, nil
+}
+
+// logMessage mirrors the records written by mitmdump.py.
+type logMessage struct {
+	Ts      float64 `json:"ts"`
+	Request struct {
+		Method  string            `json:"method"`
+		Headers map[string]string `json:"headers"`
+		URL     string            `json:"url"`
+		Text    string            `json:"text"`
+	} `json:"request"`
+	Response struct {
+		Status  int               `json:"status_code"`
+		Headers map[string]string `json:"headers"`
+		Cookies map[string]string `json:"cookies"`
+		Text    string            `json:"text"`
+	} `json:"response"`
+}
+
+func (p *Proxy) record(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+	var m logMessage
+	m.Ts = float64(time.Now().UnixNano()) / 1e9
+	m.Request.Method = req.Method
+	m.Request.Headers = flatten(req.Header)
+	m.Request.Headers["Host"] = req.Host
+	m.Request.URL = req.URL.String()
+	m.Request.Text = decode(req.Header, reqBody)
+	m.Response.Status = resp.StatusCode
+	m.Response.Headers = flatten(resp.Header)
+	m.Response.Cookies = make(map[string]string)
+	for _, c := range resp.Cookies() {
+		m.Response.Cookies[c.Name] = c.Value
+	}
+	m.Response.Text = decode(resp.Header, respBody)
+	line, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("ERROR: could not serialize %s: %v", req.URL, err)
+		return
+	}
+	p.Sink(line)
+}
+
+func flatten(h http.Header) map[string]string {
+	m := make(map[string]string)
+	for k, v := range h {
+		m[k] = strings.Join(v, ", ")
+	}
+	return m
+}
+
+// decode returns body as text, undoing gzip content encoding like mitmproxy
+// does.
+func decode(h http.Header, body []byte) string {
+	if strings.EqualFold(h.Get("Content-Encoding"), "gzip") {
+		if r, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if decoded, err := ioutil.ReadAll(r); err == nil {
+				return string(decoded)
+			}
+		}
+	}
+	return string(body)
+}
+
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Upgrade"}
+
+func removeHopHeaders(h http.Header) {
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// prefixConn is a connection whose first bytes were already read into r.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// readOnlyConn fails writes, so that a TLS handshake used to parse a
+// ClientHello cannot respond.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+var errHelloSeen = errors.New("ClientHello seen")
+
+// peekSNI reads a TLS ClientHello from conn and returns the server name along
+// with the bytes consumed, which must be replayed to whoever handles the
+// connection next.
+func peekSNI(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var sni string
+	var once sync.Once
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			once.Do(func() { sni = hello.ServerName })
+			return nil, errHelloSeen
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloSeen) && sni == "" {
+		return "", buf.Bytes(), err
+	}
+	return sni, buf.Bytes(), nil
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestProxy returns a proxy serving on a test server, sending recorded lines
+// to the returned channel and connecting every upstream request to upstream.
+func newTestProxy(t *testing.T, upstream *httptest.Server) (*Proxy, *httptest.Server, chan []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan []byte, 10)
+	p := New(ca, func(line []byte) { lines <- line })
+	addr := upstream.Listener.Addr().String()
+	dial := func(network, _ string) (net.Conn, error) { return net.Dial(network, addr) }
+	p.Dial = dial
+	p.Transport = &http.Transport{
+		DisableCompression: true,
+		TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(_ context.Context, network, a string) (net.Conn, error) {
+			return dial(network, a)
+		},
+	}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return p, srv, lines
+}
+
+// client returns an HTTP client using the proxy and trusting roots.
+func client(t *testing.T, srv *httptest.Server, roots *x509.CertPool) *http.Client {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:              http.ProxyURL(u),
+		TLSClientConfig:    &tls.Config{RootCAs: roots},
+		DisableCompression: true,
+	}}
+}
+
+func TestInterceptHTTPS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if string(body) != `{"channel": "chan"}` {
+			t.Errorf("upstream got body %q", body)
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"success": true}`))
+		gz.Close()
+	}))
+	defer upstream.Close()
+	p, srv, lines := newTestProxy(t, upstream)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Certificate())
+	req, err := http.NewRequest("POST", "https://www.clubhouseapi.com/api/get_channel", strings.NewReader(`{"channel": "chan"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Token secret")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client(t, srv, roots).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.TLS.PeerCertificates[0].Issuer.CommonName != p.CA.Certificate().Subject.CommonName {
+		t.Errorf("response not served with a certificate issued by the proxy CA")
+	}
+	// The app gets the response as sent, still compressed.
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("response is not gzipped: %v", err)
+	}
+	if body, _ := ioutil.ReadAll(gz); string(body) != `{"success": true}` {
+		t.Errorf("response body %q", body)
+	}
+
+	// The fields written by mitmdump.py, declared separately from logMessage
+	// so that renaming one of its fields fails the test.
+	var m struct {
+		Ts      float64 `json:"ts"`
+		Request struct {
+			Method  string            `json:"method"`
+			Headers map[string]string `json:"headers"`
+			URL     string            `json:"url"`
+			Text    string            `json:"text"`
+		} `json:"request"`
+		Response struct {
+			Status  int               `json:"status_code"`
+			Headers map[string]string `json:"headers"`
+			Cookies map[string]string `json:"cookies"`
+			Text    string            `json:"text"`
+		} `json:"response"`
+	}
+	line := <-lines
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&m); err != nil {
+		t.Fatalf("could not decode %s: %v", line, err)
+	}
+	if m.Ts == 0 {
+		t.Error("ts not set")
+	}
+	if m.Request.Method != "POST" || m.Request.URL != "https://www.clubhouseapi.com/api/get_channel" || m.Request.Text != `{"channel": "chan"}` {
+		t.Errorf("request recorded as %+v", m.Request)
+	}
+	if m.Request.Headers["Host"] != "www.clubhouseapi.com" || m.Request.Headers["Authorization"] != "Token secret" {
+		t.Errorf("request headers recorded as %v", m.Request.Headers)
+	}
+	if m.Response.Status != 200 || m.Response.Text != `{"success": true}` || m.Response.Cookies["session"] != "abc" {
+		t.Errorf("response recorded as %+v", m.Response)
+	}
+	if m.Response.Headers["Content-Encoding"] != "gzip" {
+		t.Errorf("response headers recorded as %v", m.Response.Headers)
+	}
+}
+
+func TestTunnelOtherHosts(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	_, srv, lines := newTestProxy(t, upstream)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	c := client(t, srv, roots)
+	c.Transport.(*http.Transport).TLSClientConfig.ServerName = "example.com"
+	resp, err := c.Get("https://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !resp.TLS.PeerCertificates[0].Equal(upstream.Certificate()) {
+		t.Error("tunnelled connection not served with the upstream certificate")
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "upstream" {
+		t.Errorf("response body %q", body)
+	}
+	if len(lines) > 0 {
+		t.Errorf("tunnelled request recorded: %s", <-lines)
+	}
+}
+
+func TestRefusedRequests(t *testing.T) {
+	p := New(nil, nil)
+	for _, tc := range []struct {
+		desc, method, target, remote string
+		want                         int
+	}{
+		{"client outside allowed networks", "CONNECT", "example.com:443", "192.0.2.1:1234", http.StatusForbidden},
+		{"plain HTTP from outside", "GET", "http://www.clubhouseapi.com/", "192.0.2.1:1234", http.StatusForbidden},
+		{"port other than 443", "CONNECT", "example.com:22", "192.168.1.2:1234", http.StatusForbidden},
+		{"loopback", "CONNECT", "127.0.0.1:443", "192.168.1.2:1234", http.StatusBadGateway},
+		{"name resolving to loopback", "CONNECT", "localhost:443", "192.168.1.2:1234", http.StatusBadGateway},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.method == "CONNECT" {
+			req.Host = tc.target
+		}
+		req.RemoteAddr = tc.remote
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.desc, w.Code, tc.want)
+		}
+	}
+}
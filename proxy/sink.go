@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSink appends lines to path, like mitmdump.py does.
+func FileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	var mu sync.Mutex
+	return func(line []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			log.Printf("ERROR: could not write to %s: %v", path, err)
+		}
+	}, nil
+}
+
+// TCPSink sends lines to a tcp:// log source at addr, reconnecting as needed.
+// Lines are dropped while the source is unreachable.
+func TCPSink(addr string) Sink {
+	var mu sync.Mutex
+	var conn net.Conn
+	var retryAt time.Time
+	return func(line []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if conn == nil {
+			if time.Now().Before(retryAt) {
+				return
+			}
+			var err error
+			if conn, err = net.DialTimeout("tcp", addr, 5*time.Second); err != nil {
+				log.Printf("WARN: could not connect to %s, dropping lines for 10s: %v", addr, err)
+				retryAt = time.Now().Add(10 * time.Second)
+				return
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(append(line, '\n')); err != nil {
+			log.Printf("WARN: could not send line to %s: %v", addr, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// MultiSink sends each line to all sinks.
+func MultiSink(sinks ...Sink) Sink {
+	return func(line []byte) {
+		for _, s := range sinks {
+			s(line)
+		}
+	}
+}
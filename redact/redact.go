@@ -0,0 +1,291 @@
+// Package redact masks secrets and personal data in log output and exports, so
+// that logs can be shared in bug reports without scrubbing them by hand.
+package redact
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Field is a kind of data that can be redacted.
+type Field string
+
+const (
+	// Token covers Authorization headers, pubnub auth keys and cookies.
+	Token Field = "token"
+	// DeviceID covers CH-DeviceId headers.
+	DeviceID Field = "device_id"
+	// Name covers user names and usernames.
+	Name Field = "name"
+	// Photo covers profile photo URLs.
+	Photo Field = "photo"
+)
+
+var allFields = []Field{Token, DeviceID, Name, Photo}
+
+// DefaultFields are redacted unless configured otherwise.
+const DefaultFields = "token,device_id"
+
+// Parse parses a comma-separated list of fields, e.g. "token,name". "all"
+// enables every field and "none" or an empty string disables redaction.
+func Parse(spec string) ([]Field, error) {
+	var fields []Field
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		switch s {
+		case "", "none":
+			continue
+		case "all":
+			fields = append(fields, allFields...)
+			continue
+		}
+		f := Field(s)
+		valid := false
+		for _, a := range allFields {
+			valid = valid || a == f
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown redaction field %q", s)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// pattern finds values of field. The first group matches the key, which is
+// kept, and the rest of the match is the value.
+type pattern struct {
+	field Field
+	re    *regexp.Regexp
+}
+
+const mask = "[REDACTED]"
+
+var patterns = []pattern{
+	{Token, regexp.MustCompile(`(?i)((?:authorization|proxy-authorization)"?\s*[:=]\s*"?)(?:(?:token|bearer|basic)\s+)?[^\s",}\]]+`)},
+	{Token, regexp.MustCompile(`(?i)(\b(?:token|bearer|basic) )[A-Za-z0-9+/=._-]{16,}`)},
+	{Token, regexp.MustCompile(`([?&](?:auth|token|auth_key)=)[^&\s",:]+`)},
+	{Token, regexp.MustCompile(`("(?:pubnub_token|auth_token|access_token|refresh_token|token)"\s*:\s*")[^"]*`)},
+	{Token, regexp.MustCompile(`(?i)((?:set-)?cookie"?\s*[:=]\s*"?)[^"\n]+`)},
+	{DeviceID, regexp.MustCompile(`(?i)(ch-deviceid"?\s*[:=]\s*"?)[^\s",}\]]+`)},
+	{DeviceID, regexp.MustCompile(`("device_id"\s*:\s*")[^"]*`)},
+	{Name, regexp.MustCompile(`("(?:name|username|first_name|displayname)"\s*:\s*")[^"]*`)},
+	{Photo, regexp.MustCompile(`("photo_url"\s*:\s*")[^"]*`)},
+	{Photo, regexp.MustCompile(`(PhotoURL:)\S+`)},
+}
+
+// Learned values shorter than these are not redacted verbatim, since they
+// would mask unrelated text. Short names are still masked in the JSON fields
+// matched by patterns.
+const (
+	minNameLength  = 5
+	minValueLength = 8
+)
+
+// maxKnown bounds the number of learned values; the oldest are forgotten
+// first.
+const maxKnown = 10000
+
+// Redactor masks the enabled fields, both by pattern and by looking for values
+// it learned, e.g. harvested credentials or the names of users in a room.
+// Learned names are only masked as whole words, and other values wherever they
+// appear.
+type Redactor struct {
+	fields map[Field]bool
+
+	mu    sync.Mutex
+	known map[string]Field
+	order []string
+	// names indexes learned names by their first word, longest name first.
+	names map[string][]string
+}
+
+func New(fields ...Field) *Redactor {
+	r := &Redactor{fields: make(map[Field]bool), known: make(map[string]Field), names: make(map[string][]string)}
+	for _, f := range fields {
+		r.fields[f] = true
+	}
+	return r
+}
+
+// Enabled tells whether f is redacted.
+func (r *Redactor) Enabled(f Field) bool { return r.fields[f] }
+
+func isWordRune(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// firstWord returns the leading word of s, which is empty if s does not start
+// with a word character.
+func firstWord(s string) string {
+	if i := strings.IndexFunc(s, func(c rune) bool { return !isWordRune(c) }); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// Learn makes r redact value wherever it appears, if f is enabled. Names must
+// start with a word character.
+func (r *Redactor) Learn(f Field, value string) {
+	value = strings.TrimSpace(value)
+	if !r.fields[f] {
+		return
+	}
+	if f == Name && (utf8.RuneCountInString(value) < minNameLength || firstWord(value) == "") {
+		return
+	}
+	if f != Name && len(value) < minValueLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.known[value]; ok {
+		return
+	}
+	r.known[value] = f
+	r.order = append(r.order, value)
+	if f == Name {
+		w := firstWord(value)
+		names := append(r.names[w], value)
+		sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+		r.names[w] = names
+	}
+	for len(r.order) > maxKnown {
+		r.forget(r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// forget must be called with r.mu held.
+func (r *Redactor) forget(value string) {
+	if r.known[value] == Name {
+		w := firstWord(value)
+		var names []string
+		for _, n := range r.names[w] {
+			if n != value {
+				names = append(names, n)
+			}
+		}
+		if len(names) > 0 {
+			r.names[w] = names
+		} else {
+			delete(r.names, w)
+		}
+	}
+	delete(r.known, value)
+}
+
+// Value returns the mask for a value of field f, or the value itself if f is
+// not redacted. Names are replaced by a stable pseudonym, so that the same user
+// can still be followed through a log.
+func (r *Redactor) Value(f Field, value string) string {
+	if !r.fields[f] || value == "" {
+		return value
+	}
+	if f == Name {
+		sum := sha256.Sum256([]byte(value))
+		return fmt.Sprintf("[name:%x]", sum[:4])
+	}
+	return mask
+}
+
+// String redacts s.
+func (r *Redactor) String(s string) string {
+	if len(r.fields) == 0 {
+		return s
+	}
+	for _, p := range patterns {
+		if !r.fields[p.field] {
+			continue
+		}
+		p := p
+		s = p.re.ReplaceAllStringFunc(s, func(m string) string {
+			key := p.re.FindStringSubmatch(m)[1]
+			return key + r.Value(p.field, m[len(key):])
+		})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for v, f := range r.known {
+		if f != Name {
+			s = strings.Replace(s, v, r.Value(f, v), -1)
+		}
+	}
+	if len(r.names) > 0 {
+		s = r.replaceNames(s)
+	}
+	return s
+}
+
+// replaceNames masks learned names occurring in s as whole words. It must be
+// called with r.mu held.
+func (r *Redactor) replaceNames(s string) string {
+	var b strings.Builder
+	prev := ' '
+	for i := 0; i < len(s); {
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if isWordRune(c) && !isWordRune(prev) {
+			rest := s[i:]
+			matched := ""
+			for _, n := range r.names[firstWord(rest)] {
+				if !strings.HasPrefix(rest, n) {
+					continue
+				}
+				if next, _ := utf8.DecodeRuneInString(rest[len(n):]); len(rest) == len(n) || !isWordRune(next) {
+					matched = n
+					break
+				}
+			}
+			if matched != "" {
+				b.WriteString(r.Value(Name, matched))
+				prev, _ = utf8.DecodeLastRuneInString(matched)
+				i += len(matched)
+				continue
+			}
+		}
+		b.WriteString(s[i : i+size])
+		prev = c
+		i += size
+	}
+	return b.String()
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+// Writer returns a writer that redacts everything written to w. Each write is
+// redacted separately, which suits loggers writing whole lines.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &writer{r: r, w: w}
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.String(string(b))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Default is the redactor used by Learn. It redacts nothing until Install is
+// called.
+var Default = New()
+
+// Install makes r the default redactor and redacts the standard logger's
+// output with it. It should be called at startup, before logging starts.
+func Install(r *Redactor) {
+	Default = r
+	log.SetOutput(r.Writer(log.Writer()))
+}
+
+// Learn makes the default redactor redact value, if f is enabled.
+func Learn(f Field, value string) { Default.Learn(f, value) }
@@ -0,0 +1,81 @@
+package redact
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPatterns(t *testing.T) {
+	name := New(Name).Value(Name, "Jane Doe")
+	for _, tc := range []struct {
+		field   Field
+		in, out string
+	}{
+		{Token, `"Authorization": "Token 0123456789abcdef"`, `"Authorization": "[REDACTED]"`},
+		{Token, `Proxy-Authorization: Basic dXNlcjpwYXNz`, `Proxy-Authorization: [REDACTED]`},
+		{Token, `map[Authorization:Token abc]`, `map[Authorization:[REDACTED]]`},
+		{Token, `sent Bearer 0123456789abcdef0123`, `sent Bearer [REDACTED]`},
+		{Token, `sent Bearer short`, `sent Bearer short`},
+		{Token, `/v2/subscribe/sub-c/channel/0?auth=secret&uuid=1`, `/v2/subscribe/sub-c/channel/0?auth=[REDACTED]&uuid=1`},
+		{Token, `{"pubnub_token": "secret", "channel": "x"}`, `{"pubnub_token": "[REDACTED]", "channel": "x"}`},
+		{Token, `"Set-Cookie": "session=abc; Path=/"`, `"Set-Cookie": "[REDACTED]"`},
+		{DeviceID, `"CH-DeviceId": "0A1B-2C3D"`, `"CH-DeviceId": "[REDACTED]"`},
+		{DeviceID, `{"device_id": "0A1B-2C3D"}`, `{"device_id": "[REDACTED]"}`},
+		{Name, `{"name": "Jane Doe", "user_id": 2}`, `{"name": "` + name + `", "user_id": 2}`},
+		{Name, `{"first_name": "Jo"}`, `{"first_name": "` + New(Name).Value(Name, "Jo") + `"}`},
+		{Photo, `{"photo_url": "https://example.com/p.jpg"}`, `{"photo_url": "[REDACTED]"}`},
+		{Photo, `&{UserID:2 PhotoURL:https://example.com/p.jpg IsSpeaker:false}`, `&{UserID:2 PhotoURL:[REDACTED] IsSpeaker:false}`},
+	} {
+		if got := New(tc.field).String(tc.in); got != tc.out {
+			t.Errorf("%s: String(%q) = %q, want %q", tc.field, tc.in, got, tc.out)
+		}
+		if got := New().String(tc.in); got != tc.in {
+			t.Errorf("with nothing enabled, String(%q) = %q", tc.in, got)
+		}
+	}
+}
+
+func TestLearn(t *testing.T) {
+	r := New(Token, Name)
+	r.Learn(Token, "0123456789abcdef")
+	r.Learn(Token, "short")
+	r.Learn(DeviceID, "0A1B-2C3D-4E5F")
+	for _, n := range []string{"Max", "Will", "Janie Doe", "Janie", "Tomás", "art_lover"} {
+		r.Learn(Name, n)
+	}
+	janie, janieDoe := r.Value(Name, "Janie"), r.Value(Name, "Janie Doe")
+	tomas, artLover := r.Value(Name, "Tomás"), r.Value(Name, "art_lover")
+	for _, tc := range []struct{ in, out string }{
+		{"token 0123456789abcdef in text", "token [REDACTED] in text"},
+		{"x0123456789abcdefx", "x[REDACTED]x"},
+		{"short and 0A1B-2C3D-4E5F", "short and 0A1B-2C3D-4E5F"},
+		{"Max and Will will start", "Max and Will will start"},
+		{"Janie Doe and Janie met Janies", janieDoe + " and " + janie + " met Janies"},
+		{"(Janie), Janie_x, Janie", "(" + janie + "), Janie_x, " + janie},
+		{"Tomás spoke; Tomása did not", tomas + " spoke; Tomása did not"},
+		{"@art_lover said art", "@" + artLover + " said art"},
+		{"bad \xff bytes Janie", "bad \xff bytes " + janie},
+	} {
+		if got := r.String(tc.in); got != tc.out {
+			t.Errorf("String(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+func TestLearnBounded(t *testing.T) {
+	r := New(Name)
+	for i := 0; i < maxKnown+10; i++ {
+		r.Learn(Name, fmt.Sprintf("user%d", i))
+	}
+	if len(r.known) != maxKnown {
+		t.Errorf("%d values known, want %d", len(r.known), maxKnown)
+	}
+	if got := r.String("user0 left"); got != "user0 left" {
+		t.Errorf("oldest name still redacted: %q", got)
+	}
+	last := fmt.Sprintf("user%d", maxKnown+9)
+	if got := r.String(last + " joined"); strings.Contains(got, last) {
+		t.Errorf("newest name not redacted: %q", got)
+	}
+}
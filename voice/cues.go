@@ -0,0 +1,149 @@
+package voice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCues is the default -cues flag value.
+const DefaultCues = "10s:Ten seconds left."
+
+// Cue is played a while before the end of a turn.
+type Cue struct {
+	Before time.Duration
+	// Text is said, or a chime is played if it is empty.
+	Text string
+}
+
+// ParseCues parses a semicolon-separated list of cues like
+// "30s;10s:Ten seconds left.", where cues without text are chimes.
+func ParseCues(spec string) ([]Cue, error) {
+	var cues []Cue
+	for _, s := range strings.Split(spec, ";") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, ":", 2)
+		d, err := time.ParseDuration(strings.TrimSpace(parts[0]))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid cue %q: want a positive duration and optional text", s)
+		}
+		cue := Cue{Before: d}
+		if len(parts) > 1 {
+			cue.Text = strings.TrimSpace(parts[1])
+		}
+		cues = append(cues, cue)
+	}
+	sort.Slice(cues, func(i, j int) bool { return cues[i].Before > cues[j].Before })
+	return cues, nil
+}
+
+// Chime plays a short tone.
+func Chime(ctx context.Context, device string) error {
+	args := []string{"-q",
+		"audiotestsrc", "wave=sine", "freq=880", "volume=0.3", "num-buffers=20",
+		"!", "audioconvert", "!", "audioresample", "!"}
+	args = append(args, strings.Split(device, " ")...)
+	cmd := exec.CommandContext(ctx, "gst-launch-1.0", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error while playing chime: %v: %s", err, out)
+	}
+	return nil
+}
+
+// Countdown plays cues as the end of a turn approaches, each once. A new one
+// is needed for every turn.
+type Countdown struct {
+	Device string
+	Cues   []Cue
+	// Pause, if set, is called while a cue plays, e.g. to keep it out of
+	// the speaker's capture, and returns a function to resume.
+	Pause func() (resume func())
+
+	played  []bool
+	playing chan struct{}
+}
+
+// PrepareCues fetches the speech for cues ahead of time.
+func PrepareCues(ctx context.Context, cues []Cue) {
+	for _, cue := range cues {
+		if cue.Text == "" {
+			continue
+		}
+		if _, err := Tts(ctx, cue.Text); err != nil {
+			log.Printf("ERROR while preparing cue %q: %v", cue.Text, err)
+		}
+	}
+}
+
+// Update starts playing the cue due at now for a turn ending at deadline, if
+// any, and returns when the next cue is due, or a zero time if none is left.
+// Cues that became due together, e.g. because the turn started late, are
+// played as one, and a cue is skipped while another is still playing. The
+// deadline may move, e.g. when a turn is extended; cues are not repeated.
+func (c *Countdown) Update(ctx context.Context, now, deadline time.Time) time.Time {
+	if c.playing == nil {
+		c.playing = make(chan struct{}, 1)
+	}
+	due, next := c.advance(now, deadline)
+	if due >= 0 {
+		select {
+		case c.playing <- struct{}{}:
+			go c.play(ctx, c.Cues[due])
+		default:
+			log.Printf("WARN: skipping cue %v before the deadline; another one is still playing", c.Cues[due].Before)
+		}
+	}
+	return next
+}
+
+// advance marks the cues due at now as played and returns the index of the
+// one to play, or -1 if none, and when the next cue is due.
+func (c *Countdown) advance(now, deadline time.Time) (int, time.Time) {
+	if c.played == nil {
+		c.played = make([]bool, len(c.Cues))
+	}
+	due := -1
+	var next time.Time
+	for i, cue := range c.Cues {
+		if c.played[i] {
+			continue
+		}
+		at := deadline.Add(-cue.Before)
+		if now.Before(at) {
+			if next.IsZero() || at.Before(next) {
+				next = at
+			}
+			continue
+		}
+		c.played[i] = true
+		if now.Before(deadline) {
+			due = i
+		}
+	}
+	return due, next
+}
+
+func (c *Countdown) play(ctx context.Context, cue Cue) {
+	defer func() { <-c.playing }()
+	if c.Pause != nil {
+		resume := c.Pause()
+		defer resume()
+	}
+	var err error
+	if cue.Text != "" {
+		err = Say(ctx, c.Device, cue.Text)
+	} else {
+		err = Chime(ctx, c.Device)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package voice
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCues(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		want    []Cue
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{spec: " ; ", want: nil},
+		{spec: DefaultCues, want: []Cue{{10 * time.Second, "Ten seconds left."}}},
+		{spec: "10s:Ten seconds left.; 30s", want: []Cue{{30 * time.Second, ""}, {10 * time.Second, "Ten seconds left."}}},
+		{spec: "1m30s: Time: almost up. ", want: []Cue{{90 * time.Second, "Time: almost up."}}},
+		{spec: "5", wantErr: true},
+		{spec: "0s", wantErr: true},
+		{spec: "-5s:Too late.", wantErr: true},
+		{spec: ":No time.", wantErr: true},
+		{spec: "30s;soon", wantErr: true},
+	} {
+		got, err := ParseCues(tc.spec)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseCues(%q) error = %v, want error %v", tc.spec, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseCues(%q) = %+v, want %+v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestCountdownAdvance(t *testing.T) {
+	start := time.Date(2021, 3, 9, 18, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	s := time.Second
+	cues := []Cue{{Before: 30 * s}, {Before: 10 * s, Text: "Ten seconds left."}}
+	type step struct {
+		now, deadline time.Duration // since start
+		due           int           // index of the cue to play, -1 for none
+		next          time.Duration // since start, -1 for none left
+	}
+	for _, tc := range []struct {
+		desc  string
+		steps []step
+	}{
+		{
+			desc: "plays each cue once as it comes due",
+			steps: []step{
+				{0, 60 * s, -1, 30 * s},
+				{30 * s, 60 * s, 0, 50 * s},
+				{31 * s, 60 * s, -1, 50 * s},
+				{50 * s, 60 * s, 1, -1},
+				{55 * s, 60 * s, -1, -1},
+			},
+		},
+		{
+			desc:  "plays only the last of cues due together",
+			steps: []step{{55 * s, 60 * s, 1, -1}, {56 * s, 60 * s, -1, -1}},
+		},
+		{
+			desc:  "skips cues once the deadline passed",
+			steps: []step{{60 * s, 60 * s, -1, -1}},
+		},
+		{
+			desc: "does not repeat a cue when the deadline moves later",
+			steps: []step{
+				{30 * s, 60 * s, 0, 50 * s},
+				{40 * s, 80 * s, -1, 70 * s},
+				{70 * s, 80 * s, 1, -1},
+			},
+		},
+		{
+			desc: "plays a cue crossed by the deadline moving earlier",
+			steps: []step{
+				{10 * s, 60 * s, -1, 30 * s},
+				{20 * s, 45 * s, 0, 35 * s},
+				{35 * s, 45 * s, 1, -1},
+			},
+		},
+	} {
+		c := &Countdown{Cues: cues}
+		for i, st := range tc.steps {
+			due, next := c.advance(at(st.now), at(st.deadline))
+			if due != st.due {
+				t.Errorf("%s: step %d: due cue %d, want %d", tc.desc, i, due, st.due)
+			}
+			want := time.Time{}
+			if st.next >= 0 {
+				want = at(st.next)
+			}
+			if !next.Equal(want) {
+				t.Errorf("%s: step %d: next cue at %v, want %v", tc.desc, i, next, want)
+			}
+		}
+	}
+}